@@ -2,9 +2,6 @@ module mohazit
 
 go 1.17
 
-require github.com/levigross/grequests v0.0.0-20190908174114-253788527a1a
+require golang.org/x/term v0.5.0
 
-require (
-	github.com/google/go-querystring v1.0.0 // indirect
-	golang.org/x/net v0.0.0-20181011144130-49bb7cea24b1 // indirect
-)
+require golang.org/x/sys v0.5.0 // indirect
@@ -0,0 +1,181 @@
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var scriptName = "script"
+var scriptArgs = []string{}
+var params = []*param{}
+var wantHelp = false
+
+type param struct {
+	Name    string
+	Default *Object
+	Help    string
+}
+
+// Exit is returned when a script asks to stop with the given exit code
+type Exit struct {
+	Code int
+}
+
+func (e *Exit) Error() string {
+	return fmt.Sprintf("exit with code %d", e.Code)
+}
+
+// SetArgs sets the name of the script and the command-line arguments passed
+// to it. The arguments are available to scripts through the `args` and
+// `arg-count` global variables.
+func SetArgs(name string, args []string) {
+	scriptName = name
+	scriptArgs = args
+	params = []*param{}
+	wantHelp = false
+	for _, a := range args {
+		if a == "--help" || a == "-h" {
+			wantHelp = true
+			break
+		}
+	}
+	setGlobal("args", NewObject(args))
+	setGlobal("arg-count", NewInt(len(args)))
+}
+
+// Args returns the command-line arguments passed to the script
+func Args() []string {
+	return scriptArgs
+}
+
+// declareParam handles a `param` statement: it reads the value of the given
+// flag from the script arguments, falling back to the default value
+func (f *frame) declareParam(stmt *Statement) (string, *Object, error) {
+	args, err := f.parseObjectList(stmt.Args)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) < 1 {
+		return "", nil, perr(stmt.KwToken, "param needs a name")
+	}
+	if args[0].Type != ObjStr {
+		return "", nil, perr(stmt.KwToken, "param names must be strings")
+	}
+	p := &param{
+		Name:    strings.TrimLeft(strings.TrimSpace(args[0].StrV), "-"),
+		Default: NewNil(),
+	}
+	if len(p.Name) < 1 {
+		return "", nil, perr(stmt.KwToken, "param names must not be empty")
+	}
+	if len(args) >= 2 {
+		p.Default = args[1]
+	}
+	if len(args) >= 3 {
+		p.Help = args[2].String()
+	}
+	params = append(params, p)
+
+	raw, found, err := p.lookup()
+	if err != nil {
+		return "", nil, perr(stmt.KwToken, err.Error())
+	}
+	if !found {
+		return p.Name, p.Default, nil
+	}
+	v, err := p.convert(raw)
+	if err != nil {
+		return "", nil, perr(stmt.KwToken, err.Error())
+	}
+	return p.Name, v, nil
+}
+
+// lookup finds the raw value of the parameter in the script arguments
+func (p *param) lookup() (string, bool, error) {
+	flag := "--" + p.Name
+	for i, a := range scriptArgs {
+		if a == "--" {
+			break
+		}
+		if strings.HasPrefix(a, flag+"=") {
+			return a[len(flag)+1:], true, nil
+		}
+		if p.Default.Type == ObjBool {
+			if a == flag {
+				return "true", true, nil
+			}
+			if a == "--no-"+p.Name {
+				return "false", true, nil
+			}
+			continue
+		}
+		if a == flag {
+			if i+1 >= len(scriptArgs) {
+				return "", false, fmt.Errorf("missing value for %s", flag)
+			}
+			return scriptArgs[i+1], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// convert turns the raw argument into an object of the same type as the
+// parameter's default value
+func (p *param) convert(raw string) (*Object, error) {
+	switch p.Default.Type {
+	case ObjInt:
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("--%s expects an integer, got %s", p.Name, raw)
+		}
+		return NewInt(v), nil
+	case ObjBool:
+		switch strings.ToLower(raw) {
+		case "true", "yes", "1":
+			return NewBool(true), nil
+		case "false", "no", "0":
+			return NewBool(false), nil
+		}
+		return nil, fmt.Errorf("--%s expects a boolean, got %s", p.Name, raw)
+	}
+	return NewStr(raw), nil
+}
+
+// needsHelp checks if the usage text should be shown before running the given
+// top-level statement. Scripts without parameters get the generic usage.
+func needsHelp(stmt *Statement) bool {
+	return wantHelp && (stmt == nil || stmt.Keyword != "param")
+}
+
+// printHelp shows the usage text generated from the declared parameters
+func printHelp() {
+	fmt.Fprintf(Stdout, "usage: %s [options]\n\noptions:\n", scriptName)
+	lines := [][2]string{}
+	width := len("--help")
+	for _, p := range params {
+		flag := "--" + p.Name
+		switch p.Default.Type {
+		case ObjBool:
+		case ObjInt:
+			flag += " <int>"
+		default:
+			flag += " <str>"
+		}
+		help := p.Help
+		if p.Default.Type != ObjNil {
+			if len(help) > 0 {
+				help += " "
+			}
+			help += "(default: " + p.Default.String() + ")"
+		}
+		lines = append(lines, [2]string{flag, help})
+		if len(flag) > width {
+			width = len(flag)
+		}
+	}
+	lines = append(lines, [2]string{"--help", "show this help"})
+	for _, l := range lines {
+		fmt.Fprintf(Stdout, "  %-*s  %s\n", width, l[0], l[1])
+	}
+}
@@ -0,0 +1,68 @@
+package lang
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits. Built-ins go through Time instead of the
+// time package, so that scripts depending on time can be tested with a
+// FakeClock.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for the given duration, giving up early once the context
+	// is done
+	Sleep(c context.Context, d time.Duration) error
+}
+
+// Time is the clock scripts use
+var Time Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(c context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// FakeClock only moves when told to. Sleeping moves it forward right away.
+type FakeClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Advance(d)
+	return nil
+}
+
+// Advance moves the clock forward by the given duration
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -1,25 +1,205 @@
 package lang
 
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Stdin is where built-ins read user input from
+var Stdin io.Reader = os.Stdin
+
+// Stdout is where built-ins write the output of the script to, and Stderr is
+// where everything else goes
+var Stdout io.Writer = os.Stdout
+var Stderr io.Writer = os.Stderr
+
+// StreamWriter finds the stream with the given name, for capture blocks that
+// write to a stream. It is provided by the library of built-ins.
+var StreamWriter func(name string) (io.Writer, bool)
+
+// captureWriter takes the output of a capture block, and of the tasks spawned
+// inside it. Whatever those tasks write once the block is over goes to where
+// the block itself was writing instead.
+type captureWriter struct {
+	lock  sync.Mutex
+	w     io.Writer
+	after io.Writer
+	done  bool
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done {
+		return c.after.Write(p)
+	}
+	return c.w.Write(p)
+}
+
+// end stops taking output
+func (c *captureWriter) end() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.done = true
+}
+
 var globals = make(map[string]*Object)
-var locals = make(map[string]*Object)
 var labels = make(map[string][]*Statement)
 
+// varsLock guards the global variables and labels, which are shared by all
+// tasks
+var varsLock sync.RWMutex
+
+// top is the frame running statements straight from the source
+var top = &frame{locals: make(map[string]*Object)}
+
+// blockEnds maps the keywords that open a block to the keyword closing it
+var blockEnds = map[string]string{
+	"if":             "end",
+	"unless":         "end",
+	"label":          "end",
+	"capture":        "end",
+	"capture-stream": "end",
+	"loop":           "while",
+	"repeat":         "while",
+}
+
+// frame is a single thread of execution: where its statements come from and
+// the local variables it can see
+type frame struct {
+	locals map[string]*Object
+	// stmts holds the statements of a block, or is nil if the statements are
+	// read from the source
+	stmts []*Statement
+	pos   int
+	// depth is how many labels deep the frame is
+	depth int
+	// out is where the output of the script goes, or nil for Stdout
+	out io.Writer
+}
+
+// output returns where the frame writes the output of the script to
+func (f *frame) output() io.Writer {
+	if f.out == nil {
+		return Stdout
+	}
+	return f.out
+}
+
+// next returns the next statement to run, or nil if there are none left
+func (f *frame) next() (*Statement, error) {
+	if f.stmts == nil {
+		for canAdvance() {
+			stmt, err := NextStmt()
+			// empty lines don't produce a statement
+			if err != nil || stmt != nil {
+				return stmt, err
+			}
+		}
+		return nil, nil
+	}
+	if f.pos >= len(f.stmts) {
+		return nil, nil
+	}
+	stmt := f.stmts[f.pos]
+	f.pos++
+	return stmt, nil
+}
+
+// block reads the statements of the block opened by the given statement, up
+// to the keyword closing it. Nested blocks are kept as they are. The statement
+// that closed the block is returned too.
+func (f *frame) block(opener *Statement) ([]*Statement, *Statement, error) {
+	want := []string{blockEnds[opener.Keyword]}
+	body := []*Statement{}
+	for {
+		stmt, err := f.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if stmt == nil {
+			return nil, nil, perrf(opener.KwToken, "%s block is never closed with %s",
+				opener.Keyword, want[0])
+		}
+		if stmt.Keyword == want[len(want)-1] {
+			want = want[:len(want)-1]
+			if len(want) == 0 {
+				return body, stmt, nil
+			}
+		} else if end, ok := blockEnds[stmt.Keyword]; ok {
+			want = append(want, end)
+		}
+		body = append(body, stmt)
+	}
+}
+
+// splitElse splits the body of an if block into the statements ran when the
+// condition is met and the ones ran when it is not
+func splitElse(body []*Statement) ([]*Statement, []*Statement, error) {
+	want := []string{}
+	split := -1
+	for i, stmt := range body {
+		if len(want) > 0 && stmt.Keyword == want[len(want)-1] {
+			want = want[:len(want)-1]
+		} else if end, ok := blockEnds[stmt.Keyword]; ok {
+			want = append(want, end)
+		} else if stmt.Keyword == "else" && len(want) == 0 {
+			if split >= 0 {
+				return nil, nil, perr(stmt.KwToken, "unexpected else")
+			}
+			split = i
+		}
+	}
+	if split < 0 {
+		return body, []*Statement{}, nil
+	}
+	return body[:split], body[split+1:], nil
+}
+
+// runBlock runs the given statements with the given local variables, at the
+// given call depth, writing output to out
+func runBlock(stmts []*Statement, locals map[string]*Object, depth int, out io.Writer) error {
+	if Limit.CallDepth > 0 && depth > Limit.CallDepth {
+		return &LimitError{LimitCallDepth, int64(Limit.CallDepth)}
+	}
+	f := &frame{locals: locals, stmts: stmts, depth: depth, out: out}
+	for {
+		stmt, err := f.next()
+		if err != nil {
+			return err
+		}
+		if stmt == nil {
+			return nil
+		}
+		if err := f.run(stmt, true); err != nil {
+			return err
+		}
+	}
+}
+
 // DoAll runs as many statements as possible, stopping if there's a problem
 // reading the next statement (first value will be false) or if there's a
 // problem executing said statement (first value will be true)
 func DoAll() error {
 	for {
-		if !canAdvance() {
-			return nil
-		}
-		stmt, err := NextStmt()
+		stmt, err := top.next()
 		if err != nil {
 			return err
 		}
 		if stmt == nil {
-			continue
+			if needsHelp(nil) {
+				printHelp()
+				return &Exit{0}
+			}
+			return nil
+		}
+		if needsHelp(stmt) {
+			printHelp()
+			return &Exit{0}
 		}
-		if err = RunStmt(stmt, false); err != nil {
+		if err = top.run(stmt, false); err != nil {
 			return err
 		}
 	}
@@ -27,164 +207,204 @@ func DoAll() error {
 
 // RunStmt runs a singular statement, consuming more statements if necessary
 func RunStmt(stmt *Statement, isLocal bool) error {
+	return top.run(stmt, isLocal)
+}
+
+// CallLabel runs the statements of the given label in a new scope, starting
+// with the given local variables. Output goes to out, or to Stdout if out is
+// nil.
+func CallLabel(name string, locals map[string]*Object, out io.Writer) error {
+	labelStmts, ok := getLabel(name)
+	if !ok {
+		return fmt.Errorf("unknown label %s", name)
+	}
+	if locals == nil {
+		locals = make(map[string]*Object)
+	}
+	return runBlock(labelStmts, locals, 1, out)
+}
+
+// HasLabel checks if a label with the given name has been defined
+func HasLabel(name string) bool {
+	_, ok := getLabel(name)
+	return ok
+}
+
+// test evaluates the given conditional
+func (f *frame) test(cond *conditional) (bool, error) {
+	l, ok := cond.Left.Get(f)
+	if !ok {
+		return false, perr(cond.Left.Tkn, "could not determine value of left side")
+	}
+	r, ok := cond.Right.Get(f)
+	if !ok {
+		return false, perr(cond.Right.Tkn, "could not determine value of right side")
+	}
+	v, err := cond.Oper(l, r)
+	if err != nil {
+		return false, err
+	}
+	if cond.Negate {
+		v = !v
+	}
+	return v, nil
+}
+
+// run runs a singular statement, consuming more statements from the frame if
+// the statement opens a block
+func (f *frame) run(stmt *Statement, isLocal bool) error {
+	if err := checkpoint(); err != nil {
+		return err
+	}
 	switch stmt.Keyword {
 	case "if", "unless":
 		if !isLocal { // don't naively wipe locals
-			locals = make(map[string]*Object)
+			f.locals = make(map[string]*Object)
 		}
-		cond, err := parseConditional(stmt.Args, stmt.Keyword == "unless")
+		cond, err := f.parseConditional(stmt.Args, stmt.Keyword == "unless")
 		if err != nil {
 			return err
 		}
-		l, ok := cond.Left.Get()
-		if !ok {
-			return perr(cond.Left.Tkn, "could not determine value of left side")
-		}
-		r, ok := cond.Right.Get()
-		if !ok {
-			return perr(cond.Right.Tkn, "could not determine value of left side")
+		v, err := f.test(cond)
+		if err != nil {
+			return err
 		}
-		v, err := cond.Oper(l, r)
+		body, _, err := f.block(stmt)
 		if err != nil {
 			return err
 		}
-		if cond.Negate {
-			v = !v
+		then, els, err := splitElse(body)
+		if err != nil {
+			return err
 		}
-		hasElse := false
-		for {
-			substmt, err := NextStmt()
-			if err != nil {
-				return err
-			}
-			if substmt == nil {
-				break
-			}
-			switch substmt.Keyword {
-			case "else":
-				if hasElse {
-					return perr(substmt.KwToken, "unexpected else")
-				}
-				hasElse = true
-				v = !v
-			case "end":
-				return nil
-			default:
-				if v {
-					err := RunStmt(substmt, true)
-					if err != nil {
-						return err
-					}
-				}
-			}
+		if v {
+			return runBlock(then, f.locals, f.depth, f.out)
 		}
-		return nil
+		return runBlock(els, f.locals, f.depth, f.out)
 	case "loop", "repeat":
-		var cond *conditional = nil
-		body := []*Statement{}
-	loopLoop:
-		for {
-			substmt, err := NextStmt()
-			if err != nil {
-				return err
-			}
-			if substmt == nil {
-				break
-			}
-			switch substmt.Keyword {
-			case "while":
-				cond, err = parseConditional(substmt.Args, false)
-				if err != nil {
-					return err
-				}
-				break loopLoop
-			default:
-				body = append(body, substmt)
-			}
+		body, end, err := f.block(stmt)
+		if err != nil {
+			return err
 		}
-		if cond == nil {
-			return perr(stmt.KwToken, "this loop is never given a condition")
+		cond, err := f.parseConditional(end.Args, false)
+		if err != nil {
+			return err
 		}
 		for {
-			l, ok := cond.Left.Get()
-			if !ok {
-				return perr(cond.Left.Tkn, "could not determine left side value")
-			}
-			r, ok := cond.Right.Get()
-			if !ok {
-				return perr(cond.Right.Tkn, "coult not determine right side value")
+			// loops with empty bodies never reach a statement
+			if err := checkpoint(); err != nil {
+				return err
 			}
-			v, err := cond.Oper(l, r)
+			v, err := f.test(cond)
 			if err != nil {
 				return err
 			}
-			if cond.Negate {
-				v = !v
-			}
-			if v {
-				for _, s := range body {
-					err = RunStmt(s, true)
-					if err != nil {
-						return err
-					}
-				}
-			} else {
+			if !v {
 				break
 			}
+			if err = runBlock(body, f.locals, f.depth, f.out); err != nil {
+				return err
+			}
 		}
 		return nil
 	case "label":
 		if isLocal {
 			return perr(stmt.KwToken, "labels not allowed in blocks")
 		}
-		labelName, err := parseObject(stmt.Args)
+		labelName, err := f.parseObject(stmt.Args)
 		if err != nil {
 			return err
 		}
 		if labelName.Type != ObjStr {
 			return perr(stmt.Args[0], "label names must be strings")
 		}
-		labelStmts := []*Statement{}
-	labelLoop:
-		for {
-			substmt, err := NextStmt()
-			if err != nil {
-				return err
-			}
-			if substmt == nil {
-				break
-			}
-			switch substmt.Keyword {
-			case "end":
-				break labelLoop
-			default:
-				labelStmts = append(labelStmts, substmt)
-			}
+		labelStmts, _, err := f.block(stmt)
+		if err != nil {
+			return err
 		}
+		varsLock.Lock()
 		labels[labelName.StrV] = labelStmts
+		varsLock.Unlock()
+		return nil
+	case "capture", "capture-stream":
+		name, err := f.parseObject(stmt.Args)
+		if err != nil {
+			return err
+		}
+		if name.Type != ObjStr {
+			return perr(stmt.Args[0], "capture target must be a string")
+		}
+		body, _, err := f.block(stmt)
+		if err != nil {
+			return err
+		}
+		if stmt.Keyword == "capture-stream" {
+			w, ok := StreamWriter(name.StrV)
+			if !ok {
+				return perrf(stmt.Args[0], "no stream named %s is open", name.StrV)
+			}
+			c := &captureWriter{w: w, after: f.output()}
+			defer c.end()
+			return runBlock(body, f.locals, f.depth, c)
+		}
+		out := &Buffer{}
+		defer out.Release()
+		c := &captureWriter{w: out, after: f.output()}
+		err = runBlock(body, f.locals, f.depth, c)
+		c.end()
+		if err == nil {
+			err = out.Err()
+		}
+		if err != nil {
+			return err
+		}
+		// captured into a variable the same way `var` assigns
+		if isLocal {
+			f.locals[name.StrV] = NewStr(out.String())
+		} else {
+			setGlobal(name.StrV, NewStr(out.String()))
+		}
 		return nil
 	case "goto":
-		labelName, err := parseObject(stmt.Args)
+		labelName, err := f.parseObject(stmt.Args)
 		if err != nil {
 			return err
 		}
 		if labelName.Type != ObjStr {
 			return perr(stmt.Args[0], "label names must be strings")
 		}
-		labelStmts, ok := labels[labelName.StrV]
+		labelStmts, ok := getLabel(labelName.StrV)
 		if !ok {
 			return perrf(stmt.Args[0], "unknown label %s", labelName.StrV)
 		}
-		for _, substmt := range labelStmts {
-			if err := RunStmt(substmt, true); err != nil {
-				return err
-			}
-		}
-		return nil
+		return runBlock(labelStmts, f.locals, f.depth+1, f.out)
 	case "end":
 		return perr(stmt.KwToken, "end statement outside of block")
+	case "else":
+		return perr(stmt.KwToken, "else statement outside of if block")
+	case "while":
+		return perr(stmt.KwToken, "while statement outside of loop")
+	case "exit":
+		code, err := f.parseObject(stmt.Args)
+		if err != nil {
+			return err
+		}
+		switch code.Type {
+		case ObjNil:
+			return &Exit{0}
+		case ObjInt:
+			return &Exit{code.IntV}
+		}
+		return perr(stmt.Args[0], "exit code must be an integer")
+	case "param":
+		name, value, err := f.declareParam(stmt)
+		if err != nil {
+			return err
+		}
+		setGlobal(name, value)
+		return nil
 	case "local", "global", "var", "set":
-		name, value, err := parseAssignment(stmt.Args)
+		name, value, err := f.parseAssignment(stmt.Args)
 		if err != nil {
 			return err
 		}
@@ -192,38 +412,61 @@ func RunStmt(stmt *Statement, isLocal bool) error {
 			if !isLocal {
 				return perr(stmt.KwToken, "local variable in global context")
 			}
-			locals[name] = value
+			f.locals[name] = value
 		} else if stmt.Keyword == "global" {
-			globals[name] = value
+			setGlobal(name, value)
 		} else {
 			if isLocal {
-				locals[name] = value
+				f.locals[name] = value
 			} else {
-				globals[name] = value
+				setGlobal(name, value)
 			}
 		}
 		return nil
 	default:
-		f, ok := Funcs[stmt.Keyword]
+		fn, ok := Func(stmt.Keyword, f.output())
 		if !ok {
 			return perrf(stmt.KwToken, "unknown function %s", stmt.Keyword)
 		}
-		args, err := parseObjectList(stmt.Args)
+		args, err := f.parseObjectList(stmt.Args)
 		if err != nil {
 			return err
 		}
-		_, err = f(args)
-		return err
-		// TODO(qeaml): variables, labels and other special statements
+		_, err = fn(args)
+		return Interrupted(err)
 	}
 }
 
 func GetGlobalVar(name string) (v *Object, ok bool) {
+	varsLock.RLock()
+	defer varsLock.RUnlock()
 	v, ok = globals[name]
 	return
 }
 
+func setGlobal(name string, v *Object) {
+	varsLock.Lock()
+	defer varsLock.Unlock()
+	globals[name] = v
+}
+
+func getLabel(name string) ([]*Statement, bool) {
+	varsLock.RLock()
+	defer varsLock.RUnlock()
+	stmts, ok := labels[name]
+	return stmts, ok
+}
+
 func GetLocalVar(name string) (v *Object, ok bool) {
-	v, ok = locals[name]
+	v, ok = top.locals[name]
 	return
 }
+
+// lookup finds the variable with the given name, preferring local variables
+func (f *frame) lookup(name string) (v *Object, ok bool) {
+	v, ok = f.locals[name]
+	if ok {
+		return
+	}
+	return GetGlobalVar(name)
+}
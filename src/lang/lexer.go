@@ -124,11 +124,17 @@ func NextToken() *Token {
 		return makeToken(tIdent, ident)
 	}
 
-	if isDigit(c) || c == '-' {
+	if isDigit(c) || (c == '-' && pos+1 < len(source) && isDigit(peekNext())) {
 		literal := toString(advance())
 		for canAdvance() && isDigit(peek()) {
 			literal += toString(advance())
 		}
+		if canAdvance() && peek() == '.' && pos+1 < len(source) && isDigit(peekNext()) {
+			literal += toString(advance())
+			for canAdvance() && isDigit(peek()) {
+				literal += toString(advance())
+			}
+		}
 		return makeToken(tLiteral, literal)
 	}
 
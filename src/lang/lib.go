@@ -1,5 +1,7 @@
 package lang
 
+import "io"
+
 // snip!
 
 type VFunc func([]*Object) (*Object, error)
@@ -7,5 +9,29 @@ type VComp func(*Object, *Object) (bool, error)
 type VFuncMap map[string]VFunc
 type VCompMap map[string]VComp
 
+// VOutFunc is a built-in that writes the output of the script, to the writer
+// it is given
+type VOutFunc func(io.Writer, []*Object) (*Object, error)
+type VOutFuncMap map[string]VOutFunc
+
 var Funcs = make(VFuncMap)
 var Comps = make(VCompMap)
+var OutFuncs = make(VOutFuncMap)
+
+// Func finds the built-in with the given name. Built-ins that write output
+// write it to out, or to Stdout if out is nil.
+func Func(name string, out io.Writer) (VFunc, bool) {
+	if fn, ok := Funcs[name]; ok {
+		return fn, true
+	}
+	fn, ok := OutFuncs[name]
+	if !ok {
+		return nil, false
+	}
+	return func(args []*Object) (*Object, error) {
+		if out == nil {
+			return fn(Stdout, args)
+		}
+		return fn(out, args)
+	}, true
+}
@@ -0,0 +1,222 @@
+package lang
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits caps the resources a script may use. Zero values mean no limit.
+type Limits struct {
+	// Statements is the amount of statements that may be executed
+	Statements int64
+	// CallDepth is how deeply labels may call each other
+	CallDepth int
+	// BufferBytes is the amount of memory buffers may hold at once. This
+	// covers memory streams and everything read or collected as a whole, like
+	// files, process output and captured output, but not the small buffers
+	// of a fixed size streams are read through.
+	BufferBytes int64
+	// WallTime is how long a script may run for
+	WallTime time.Duration
+}
+
+// Limit holds the limits applied to scripts
+var Limit Limits
+
+// LimitKind tells which limit was exceeded
+type LimitKind int
+
+const (
+	LimitStatements LimitKind = iota
+	LimitCallDepth
+	LimitBufferBytes
+	LimitWallTime
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitStatements:
+		return "statements"
+	case LimitCallDepth:
+		return "call depth"
+	case LimitBufferBytes:
+		return "buffer memory"
+	case LimitWallTime:
+		return "wall time"
+	}
+	return "unknown"
+}
+
+// LimitError is returned when a script exceeds one of its limits
+type LimitError struct {
+	Kind LimitKind
+	// Max is the value of the limit that was exceeded
+	Max int64
+}
+
+func (e *LimitError) Error() string {
+	if e.Kind == LimitWallTime {
+		return fmt.Sprintf("limit exceeded: %s of %s", e.Kind, time.Duration(e.Max))
+	}
+	return fmt.Sprintf("limit exceeded: %s of %d", e.Kind, e.Max)
+}
+
+var ctx = context.Background()
+var ctxLock sync.RWMutex
+
+// executed is the amount of statements executed so far, and buffered is the
+// amount of memory held by buffers
+var executed int64
+var buffered int64
+
+// Context returns the context scripts are running in. Blocking built-ins
+// should give up once it is done.
+func Context() context.Context {
+	ctxLock.RLock()
+	defer ctxLock.RUnlock()
+	return ctx
+}
+
+// endRun cancels the wall time limit of the current run
+var endRun context.CancelFunc = func() {}
+
+// RunContext runs the given source until it is done, the context is
+// cancelled or one of the limits is exceeded. Tasks spawned by the script may
+// outlive it, so the context stays in place until Finish is called.
+func RunContext(c context.Context, src string) error {
+	cancel := func() {}
+	if Limit.WallTime > 0 {
+		c, cancel = context.WithTimeout(c, Limit.WallTime)
+	}
+	ctxLock.Lock()
+	endRun()
+	ctx, endRun = c, cancel
+	ctxLock.Unlock()
+	atomic.StoreInt64(&executed, 0)
+	Source(src)
+	return Interrupted(DoAll())
+}
+
+// Finish ends the run started by RunContext, once everything the script
+// spawned is done
+func Finish() {
+	ctxLock.Lock()
+	defer ctxLock.Unlock()
+	endRun()
+	ctx, endRun = context.Background(), func() {}
+}
+
+// Interrupted turns an error into the reason the script was stopped, if it
+// was. Built-ins giving up because the context is done fail with all kinds of
+// errors, which are replaced by this.
+func Interrupted(err error) error {
+	if err == nil {
+		return nil
+	}
+	cerr := Context().Err()
+	if cerr == nil {
+		return err
+	}
+	if cerr == context.DeadlineExceeded && Limit.WallTime > 0 {
+		return &LimitError{LimitWallTime, int64(Limit.WallTime)}
+	}
+	return cerr
+}
+
+// checkpoint is passed before every statement, stopping the script if it has
+// been cancelled or has run too many statements
+func checkpoint() error {
+	if err := Context().Err(); err != nil {
+		return Interrupted(err)
+	}
+	n := atomic.AddInt64(&executed, 1)
+	if Limit.Statements > 0 && n > Limit.Statements {
+		return &LimitError{LimitStatements, Limit.Statements}
+	}
+	return nil
+}
+
+// Reserve accounts for n more bytes held in buffers, failing if that would
+// exceed the buffer memory limit
+func Reserve(n int) error {
+	if Limit.BufferBytes <= 0 {
+		atomic.AddInt64(&buffered, int64(n))
+		return nil
+	}
+	for {
+		cur := atomic.LoadInt64(&buffered)
+		if cur+int64(n) > Limit.BufferBytes {
+			return &LimitError{LimitBufferBytes, Limit.BufferBytes}
+		}
+		if atomic.CompareAndSwapInt64(&buffered, cur, cur+int64(n)) {
+			return nil
+		}
+	}
+}
+
+// Release gives back n bytes previously reserved
+func Release(n int) {
+	atomic.AddInt64(&buffered, -int64(n))
+}
+
+// Buffer collects bytes, which count towards the buffer memory limit until
+// it is released
+type Buffer struct {
+	buf      bytes.Buffer
+	reserved int
+	err      error
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	if err := Reserve(len(p)); err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return 0, err
+	}
+	b.reserved += len(p)
+	return b.buf.Write(p)
+}
+
+func (b *Buffer) WriteString(s string) (int, error) {
+	return b.Write([]byte(s))
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *Buffer) String() string {
+	return b.buf.String()
+}
+
+func (b *Buffer) Len() int {
+	return b.buf.Len()
+}
+
+// Err returns the error of the first write that did not fit, for writers
+// which ignore errors
+func (b *Buffer) Err() error {
+	return b.err
+}
+
+// Release stops counting the bytes towards the limit, once they have been
+// handed on
+func (b *Buffer) Release() {
+	Release(b.reserved)
+	b.reserved = 0
+}
+
+// ReadAll reads everything into memory, counting it towards the buffer
+// memory limit while reading
+func ReadAll(r io.Reader) ([]byte, error) {
+	var b Buffer
+	defer b.Release()
+	_, err := io.Copy(&b, r)
+	return b.Bytes(), err
+}
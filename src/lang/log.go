@@ -0,0 +1,158 @@
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log message is
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelQuiet is above every message, hiding them all
+	LevelQuiet
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "quiet"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelQuiet {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel finds the level with the given name
+func ParseLevel(name string) (Level, bool) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Field is a piece of structured information attached to a log message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a field
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger writes leveled messages, either as text or as JSON lines
+type Logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}
+
+// Log is used by the interpreter and built-ins for everything that isn't the
+// output of the script itself. By default only warnings and errors are shown.
+var Log = NewLogger(nil, LevelWarn)
+
+// NewLogger creates a logger writing to out, or to Stderr if out is nil
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, level: level}
+}
+
+func (l *Logger) SetOutput(out io.Writer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out = out
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level = level
+}
+
+func (l *Logger) Level() Level {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.level
+}
+
+// SetJSON switches between text and JSON lines output
+func (l *Logger) SetJSON(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.json = enabled
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if level < l.level {
+		return
+	}
+	var line []byte
+	if l.json {
+		line = jsonLine(level, msg, fields)
+	} else {
+		line = textLine(level, msg, fields)
+	}
+	out := l.out
+	if out == nil {
+		out = Stderr
+	}
+	out.Write(line)
+}
+
+func textLine(level Level, msg string, fields []Field) []byte {
+	b := &strings.Builder{}
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(b, " %s=%s", f.Key, v)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func jsonLine(level Level, msg string, fields []Field) []byte {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			entry[f.Key] = err.Error()
+		} else {
+			entry[f.Key] = f.Value
+		}
+	}
+	entry["time"] = Time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"level": level.String(),
+			"msg":   msg,
+			"error": err.Error(),
+		})
+	}
+	return append(line, '\n')
+}
@@ -1,8 +1,12 @@
 package lang
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type ObjectType uint8
@@ -13,6 +17,10 @@ const (
 	ObjInt
 	ObjBool
 	ObjRef
+	ObjList
+	ObjFloat
+	ObjMap
+	ObjBytes
 )
 
 func (t ObjectType) String() string {
@@ -25,15 +33,28 @@ func (t ObjectType) String() string {
 		return "Int"
 	case ObjBool:
 		return "Bool"
+	case ObjList:
+		return "List"
+	case ObjFloat:
+		return "Float"
+	case ObjMap:
+		return "Map"
+	case ObjBytes:
+		return "Bytes"
 	}
 	panic("invalid object type: " + string(uint8(t)))
 }
 
 type Object struct {
-	Type  ObjectType
-	StrV  string
-	IntV  int
-	BoolV bool
+	Type   ObjectType
+	StrV   string
+	IntV   int
+	BoolV  bool
+	ListV  []*Object
+	FloatV float64
+	MapV   map[string]*Object
+	// BytesV holds binary data, which may not be valid text
+	BytesV []byte
 }
 
 func (o *Object) Repr() string {
@@ -46,6 +67,22 @@ func (o *Object) Repr() string {
 		return fmt.Sprintf("[Int %d]", o.IntV)
 	case ObjBool:
 		return fmt.Sprintf("[Bool %t]", o.BoolV)
+	case ObjList:
+		items := make([]string, len(o.ListV))
+		for i, v := range o.ListV {
+			items[i] = v.Repr()
+		}
+		return "[List " + strings.Join(items, " ") + "]"
+	case ObjFloat:
+		return fmt.Sprintf("[Float %g]", o.FloatV)
+	case ObjMap:
+		items := []string{}
+		for _, k := range o.Keys() {
+			items = append(items, k+": "+o.MapV[k].Repr())
+		}
+		return "[Map " + strings.Join(items, ", ") + "]"
+	case ObjBytes:
+		return "[Bytes " + hex.EncodeToString(o.BytesV) + "]"
 	}
 	panic("object of invalid type: " + string(uint8(o.Type)))
 }
@@ -60,17 +97,47 @@ func (o *Object) String() string {
 		return fmt.Sprint(o.IntV)
 	case ObjBool:
 		return fmt.Sprint(o.BoolV)
+	case ObjList:
+		items := make([]string, len(o.ListV))
+		for i, v := range o.ListV {
+			items[i] = v.String()
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case ObjFloat:
+		return strconv.FormatFloat(o.FloatV, 'g', -1, 64)
+	case ObjMap:
+		items := []string{}
+		for _, k := range o.Keys() {
+			items = append(items, k+": "+o.MapV[k].String())
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case ObjBytes:
+		return string(o.BytesV)
 	}
 	panic("object of invalid type: " + string(o.Type))
 }
 
 func (o *Object) Clone() *Object {
 	return &Object{
-		Type:  o.Type,
-		StrV:  o.StrV,
-		IntV:  o.IntV,
-		BoolV: o.BoolV,
+		Type:   o.Type,
+		StrV:   o.StrV,
+		IntV:   o.IntV,
+		BoolV:  o.BoolV,
+		ListV:  o.ListV,
+		FloatV: o.FloatV,
+		MapV:   o.MapV,
+		BytesV: o.BytesV,
+	}
+}
+
+// Keys returns the keys of a map object in sorted order
+func (o *Object) Keys() []string {
+	keys := make([]string, 0, len(o.MapV))
+	for k := range o.MapV {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (o *Object) TryConvert(t ObjectType) (*Object, bool) {
@@ -81,10 +148,15 @@ func (o *Object) TryConvert(t ObjectType) (*Object, bool) {
 		return o.convertBool()
 	case ObjInt:
 		return o.convertInt()
+	case ObjFloat:
+		return o.convertFloat()
+	case ObjBytes:
+		return o.convertBytes()
 	case ObjNil:
 		return &Object{Type: ObjNil}, true
 	}
-	panic("object of invalid type: " + string(o.Type))
+	// lists and maps can't be made from anything else
+	return nil, false
 }
 
 func (o *Object) convertString() (*Object, bool) {
@@ -103,6 +175,14 @@ func (o *Object) convertBool() (*Object, bool) {
 		v = o.IntV > 0
 	case ObjNil:
 		v = false
+	case ObjList:
+		v = len(o.ListV) > 0
+	case ObjFloat:
+		v = o.FloatV > 0
+	case ObjMap:
+		v = len(o.MapV) > 0
+	case ObjBytes:
+		v = len(o.BytesV) > 0
 	default:
 		return nil, false
 	}
@@ -125,6 +205,8 @@ func (o *Object) convertInt() (*Object, bool) {
 		if o.BoolV {
 			v = 1
 		}
+	case ObjFloat:
+		v = int(o.FloatV)
 	case ObjNil:
 		v = 0
 	default:
@@ -136,6 +218,42 @@ func (o *Object) convertInt() (*Object, bool) {
 	}, true
 }
 
+func (o *Object) convertFloat() (*Object, bool) {
+	v := 0.0
+	switch o.Type {
+	case ObjStr:
+		parsed, err := strconv.ParseFloat(o.StrV, 64)
+		if err != nil {
+			return nil, false
+		}
+		v = parsed
+	case ObjInt:
+		v = float64(o.IntV)
+	case ObjBool:
+		if o.BoolV {
+			v = 1
+		}
+	case ObjNil:
+		v = 0
+	default:
+		return nil, false
+	}
+	return &Object{
+		Type:   ObjFloat,
+		FloatV: v,
+	}, true
+}
+
+func (o *Object) convertBytes() (*Object, bool) {
+	switch o.Type {
+	case ObjBytes:
+		return o, true
+	case ObjList, ObjMap:
+		return nil, false
+	}
+	return NewBytes([]byte(o.String())), true
+}
+
 func NewStr(txt string) *Object {
 	return &Object{
 		Type: ObjStr,
@@ -150,6 +268,13 @@ func NewInt(val int) *Object {
 	}
 }
 
+func NewFloat(val float64) *Object {
+	return &Object{
+		Type:   ObjFloat,
+		FloatV: val,
+	}
+}
+
 func NewNil() *Object {
 	return &Object{
 		Type: ObjNil,
@@ -163,6 +288,27 @@ func NewBool(val bool) *Object {
 	}
 }
 
+func NewList(items []*Object) *Object {
+	return &Object{
+		Type:  ObjList,
+		ListV: items,
+	}
+}
+
+func NewMap(items map[string]*Object) *Object {
+	return &Object{
+		Type: ObjMap,
+		MapV: items,
+	}
+}
+
+func NewBytes(data []byte) *Object {
+	return &Object{
+		Type:   ObjBytes,
+		BytesV: data,
+	}
+}
+
 func NewObject(val interface{}) *Object {
 	if val == nil {
 		return NewNil()
@@ -174,6 +320,26 @@ func NewObject(val interface{}) *Object {
 		return NewInt(v)
 	} else if v, ok := val.(bool); ok {
 		return NewBool(v)
+	} else if v, ok := val.(float64); ok {
+		return NewFloat(v)
+	} else if v, ok := val.([]byte); ok {
+		return NewBytes(v)
+	} else if v, ok := val.([]*Object); ok {
+		return NewList(v)
+	} else if v, ok := val.([]string); ok {
+		items := make([]*Object, len(v))
+		for i, s := range v {
+			items[i] = NewStr(s)
+		}
+		return NewList(items)
+	} else if v, ok := val.(map[string]*Object); ok {
+		return NewMap(v)
+	} else if v, ok := val.(map[string]string); ok {
+		items := make(map[string]*Object, len(v))
+		for k, s := range v {
+			items[k] = NewStr(s)
+		}
+		return NewMap(items)
 	}
 	panic("unsupported value: " + fmt.Sprint(val))
 }
@@ -191,25 +357,45 @@ func (a *Object) Equals(b *Object) bool {
 		return a.BoolV == b.BoolV
 	case ObjStr:
 		return a.StrV == b.StrV
+	case ObjFloat:
+		return a.FloatV == b.FloatV
+	case ObjList:
+		if len(a.ListV) != len(b.ListV) {
+			return false
+		}
+		for i := range a.ListV {
+			if !a.ListV[i].Equals(b.ListV[i]) {
+				return false
+			}
+		}
+		return true
+	case ObjMap:
+		if len(a.MapV) != len(b.MapV) {
+			return false
+		}
+		for k, av := range a.MapV {
+			bv, ok := b.MapV[k]
+			if !ok || !av.Equals(bv) {
+				return false
+			}
+		}
+		return true
+	case ObjBytes:
+		return bytes.Equal(a.BytesV, b.BytesV)
 	}
 	panic("object of invalid type: " + string(a.Type))
 }
 
 type refreshable struct {
-	Tkn *Token
-	isVar      bool
-	varName    string
-	obj        *Object
+	Tkn     *Token
+	isVar   bool
+	varName string
+	obj     *Object
 }
 
-func (r refreshable) Get() (v *Object, ok bool) {
+func (r refreshable) Get(f *frame) (v *Object, ok bool) {
 	if r.isVar {
-		v, ok = locals[r.varName]
-		if ok {
-			return
-		}
-		v, ok = globals[r.varName]
-		return
+		return f.lookup(r.varName)
 	}
 	return r.obj, true
 }
@@ -52,14 +52,19 @@ func NextStmt() (*Statement, error) {
 }
 
 // Args reads a slice of objects from the given token slice
-func parseObjectList(tkns []*Token) ([]*Object, error) {
+func (f *frame) parseObjectList(tkns []*Token) ([]*Object, error) {
 	out := []*Object{}
 	raw := [][]*Token{}
 outer:
 	for i := 0; i < len(tkns); i++ {
 		tkn := tkns[i]
 		this := []*Token{}
-		switch tkn.Type {
+		kind := tkn.Type
+		if kind == tLiteral && i+1 < len(tkns) && joinsLiteral(tkns[i+1]) {
+			// a number directly followed by text, like 5s, is text
+			kind = tUnknown
+		}
+		switch kind {
 		case tSpace, tLinefeed:
 			// ignore
 		case tIdent, tUnknown, tBracket:
@@ -80,11 +85,15 @@ outer:
 		case tLiteral, tRef:
 			raw = append(raw, []*Token{tkn})
 		case tOper:
+			if tkn.Raw == "\\" {
+				// separator after a reference or literal
+				continue
+			}
 			return nil, perrf(tkn, "unexpected token: %s", tkn.Type)
 		}
 	}
 	for _, src := range raw {
-		o, err := parseObject(src)
+		o, err := f.parseObject(src)
 		if err != nil {
 			return nil, err
 		}
@@ -94,23 +103,23 @@ outer:
 }
 
 // Tokens2object reads a single object from the given token slice
-func parseObject(t []*Token) (*Object, error) {
+func (f *frame) parseObject(t []*Token) (*Object, error) {
 	t = trimSpaceTokens(t)
 	if len(t) < 1 {
 		return NewNil(), nil
 	}
-	switch t[0].Type {
+	kind := t[0].Type
+	if kind == tLiteral && len(t) > 1 && joinsLiteral(t[1]) {
+		kind = tUnknown
+	}
+	switch kind {
 	case tRef:
 		if len(t) > 1 {
 			return nil, perrf(t[1], "unexpected %s in reference", t[1].Type)
 		}
-		lv, ok := GetLocalVar(t[0].Raw)
-		if ok {
-			return lv, nil
-		}
-		gv, ok := GetGlobalVar(t[0].Raw)
+		v, ok := f.lookup(t[0].Raw)
 		if ok {
-			return gv, nil
+			return v, nil
 		}
 		return nil, perrf(t[0], "could not find variable %s", t[0].Raw)
 	case tBracket:
@@ -133,7 +142,8 @@ func parseObject(t []*Token) (*Object, error) {
 		for _, tkn := range t[1:] {
 			argstart++
 			switch tkn.Type {
-			case tIdent:
+			// functions may also be named with symbols, like `[!]`
+			case tIdent, tOper, tUnknown:
 				funcnames = append(funcnames, tkn)
 			case tSpace:
 				continue
@@ -148,13 +158,13 @@ func parseObject(t []*Token) (*Object, error) {
 		}
 		funcfuncs := []VFunc{}
 		for _, fn := range funcnames {
-			if ff, ok := Funcs[strings.ToLower(fn.Raw)]; ok {
+			if ff, ok := Func(strings.ToLower(fn.Raw), f.output()); ok {
 				funcfuncs = append(funcfuncs, ff)
 			} else {
 				return NewNil(), perrf(fn, "unknown function %s", fn.Raw)
 			}
 		}
-		args, err := parseObjectList(trimSpaceTokens(t[argstart+1:]))
+		args, err := f.parseObjectList(trimSpaceTokens(t[argstart+1:]))
 		if err != nil {
 			return NewNil(), err
 		}
@@ -189,6 +199,10 @@ func parseObject(t []*Token) (*Object, error) {
 		}
 		return v, nil
 	case tLiteral:
+		if strings.Contains(t[0].Raw, ".") {
+			v, err := strconv.ParseFloat(t[0].Raw, 64)
+			return NewFloat(v), err
+		}
 		v, err := strconv.Atoi(t[0].Raw)
 		return NewInt(v), err
 	default:
@@ -196,6 +210,11 @@ func parseObject(t []*Token) (*Object, error) {
 	}
 }
 
+// joinsLiteral checks if a token directly after a number makes it text
+func joinsLiteral(t *Token) bool {
+	return t.Type == tIdent || t.Type == tUnknown || t.Type == tLiteral
+}
+
 // TrimSpace removes tSpace tokens from both ends of the given token slice
 func trimSpaceTokens(t []*Token) []*Token {
 	ltrim := []*Token{}
@@ -228,16 +247,22 @@ type conditional struct {
 	Negate bool
 }
 
-func parseConditional(tokens []*Token, negate bool) (*conditional, error) {
+func (f *frame) parseConditional(tokens []*Token, negate bool) (*conditional, error) {
 	l := []*Token{}
 	var lRef string
 	var op *Token = nil
 	r := []*Token{}
 	var rRef string
-	for _, tkn := range tokens {
+	for i := 0; i < len(tokens); i++ {
+		tkn := tokens[i]
 		if op == nil {
+			if name, ok := namedComparator(tokens[i:]); ok {
+				op = name
+				i += 2
+				continue
+			}
 			switch tkn.Type {
-			case tIdent, tLiteral, tSpace, tBracket:
+			case tIdent, tLiteral, tSpace, tBracket, tUnknown:
 				l = append(l, tkn)
 			case tRef:
 				if len(lRef) > 0 {
@@ -252,7 +277,7 @@ func parseConditional(tokens []*Token, negate bool) (*conditional, error) {
 			}
 		} else {
 			switch tkn.Type {
-			case tIdent, tLiteral, tSpace, tBracket:
+			case tIdent, tLiteral, tSpace, tBracket, tUnknown:
 				r = append(r, tkn)
 			case tRef:
 				if len(rRef) > 0 {
@@ -277,7 +302,7 @@ func parseConditional(tokens []*Token, negate bool) (*conditional, error) {
 	if len(lRef) > 0 {
 		lVal = refreshable{l[0], true, lRef, nil}
 	} else {
-		o, err := parseObject(l)
+		o, err := f.parseObject(l)
 		if err != nil {
 			return nil, err
 		}
@@ -286,13 +311,13 @@ func parseConditional(tokens []*Token, negate bool) (*conditional, error) {
 	if len(rRef) > 0 {
 		rVal = refreshable{r[0], true, rRef, nil}
 	} else {
-		o, err := parseObject(r)
+		o, err := f.parseObject(r)
 		if err != nil {
 			return nil, err
 		}
 		rVal = refreshable{r[0], false, "", o}
 	}
-	c, ok := Comps[op.Raw]
+	c, ok := Comps[strings.ToLower(op.Raw)]
 	if !ok {
 		return nil, perrf(op, "unknown comparator %s", op.Raw)
 	}
@@ -304,7 +329,30 @@ func parseConditional(tokens []*Token, negate bool) (*conditional, error) {
 	}, nil
 }
 
-func parseAssignment(tokens []*Token) (string, *Object, error) {
+// namedComparator checks if the given tokens start with a `[name]` comparator
+// and returns the token holding its name
+func namedComparator(tokens []*Token) (*Token, bool) {
+	if len(tokens) < 3 {
+		return nil, false
+	}
+	if tokens[0].Type != tBracket || tokens[0].Raw != "[" ||
+		tokens[1].Type != tIdent ||
+		tokens[2].Type != tBracket || tokens[2].Raw != "]" {
+		return nil, false
+	}
+	if _, ok := Comps[strings.ToLower(tokens[1].Raw)]; !ok {
+		return nil, false
+	}
+	return tokens[1], true
+}
+
+// isCall tells if the given tokens start a processor call, like `[a b] c`
+func isCall(tokens []*Token) bool {
+	t := trimSpaceTokens(tokens)
+	return len(t) > 0 && t[0].Type == tBracket && t[0].Raw == "["
+}
+
+func (f *frame) parseAssignment(tokens []*Token) (string, *Object, error) {
 	l := []*Token{}
 	mid := false
 	r := []*Token{}
@@ -326,7 +374,14 @@ func parseAssignment(tokens []*Token) (string, *Object, error) {
 			}
 		} else {
 			switch tkn.Type {
-			case tIdent, tLiteral, tSpace, tBracket, tRef:
+			case tIdent, tLiteral, tSpace, tBracket, tRef, tUnknown:
+				r = append(r, tkn)
+			case tOper:
+				// other operators are only allowed in calls, where they are
+				// part of the function name or arguments
+				if tkn.Raw != "\\" && !isCall(r) {
+					return "", nil, perrf(tkn, "unexpected %s in variable value", tkn.Type.String())
+				}
 				r = append(r, tkn)
 			case tLinefeed:
 				break
@@ -343,7 +398,7 @@ func parseAssignment(tokens []*Token) (string, *Object, error) {
 	if lVal.Type != tIdent {
 		return "", nil, perrf(lVal, "expected identifier, got %s", lVal.Type.String())
 	}
-	rVal, err := parseObject(r)
+	rVal, err := f.parseObject(r)
 	if err != nil {
 		return "", nil, err
 	}
@@ -26,7 +26,8 @@ func isIdentStart(c byte) bool {
 // isIdenCont checks if the given byte represents a character than continues
 // an identifier
 func isIdentCont(c byte) bool {
-	return isIdentStart(c) || isDigit(c) || c == '-' || c == '.'
+	// a trailing ? is used for functions asking a question, like data-eof?
+	return isIdentStart(c) || isDigit(c) || c == '-' || c == '.' || c == '?'
 }
 
 func isBracket(c byte) bool {
@@ -58,9 +59,10 @@ func isValid(c byte) bool {
 		c == 0)
 }
 
-// toString turn the given byte into a 1-long string
+// toString turn the given byte into a 1-long string. Multi-byte characters
+// are kept intact once their bytes are concatenated back together.
 func toString(c byte) string {
-	return string(rune(c))
+	return string([]byte{c})
 }
 
 type ParseError struct {
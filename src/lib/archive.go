@@ -0,0 +1,656 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"mohazit/lang"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// archive is an archive that is being written
+type archive interface {
+	// add writes a single entry, reading file contents from the given path
+	add(name, path string, info fs.FileInfo) error
+	Close() error
+}
+
+var archives = make(map[string]archive)
+var archiveCount = 0
+var lastArchive = ""
+var archivesLock sync.Mutex
+
+type zipArchive struct {
+	f *os.File
+	w *zip.Writer
+}
+
+func (a *zipArchive) add(name, path string, info fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	w, err := a.w.CreateHeader(hdr)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+	return copyFileTo(w, path)
+}
+
+func (a *zipArchive) Close() error {
+	if err := a.w.Close(); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+type tarArchive struct {
+	f  *os.File
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a *tarArchive) add(name, path string, info fs.FileInfo) error {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := a.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return copyFileTo(a.w, path)
+}
+
+func (a *tarArchive) Close() error {
+	err := a.w.Close()
+	if a.gz != nil {
+		if gzErr := a.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if fErr := a.f.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// isGzipName tells if a tar archive should be compressed, by its name
+func isGzipName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// createArchive creates the archive file named by the first argument and
+// registers the archive under the name given by the second one, if any
+func createArchive(args []*lang.Object, open func(f *os.File) archive) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "archive file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	archivesLock.Lock()
+	defer archivesLock.Unlock()
+	var name string
+	if len(args) >= 2 {
+		name = args[1].String()
+	} else {
+		name = fmt.Sprintf("archive%d", archiveCount)
+	}
+	archiveCount++
+
+	lang.Log.Info("creating archive", lang.F("file", fileName), lang.F("archive", name))
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	archives[name] = open(f)
+	lastArchive = name
+	return lang.NewStr(name), nil
+}
+
+// archiveArg resolves the archive named by the i-th argument, falling back to
+// the last created archive
+func archiveArg(args []*lang.Object, i int) (string, archive, error) {
+	archivesLock.Lock()
+	defer archivesLock.Unlock()
+	name := lastArchive
+	if len(args) > i {
+		name = args[i].String()
+	} else if name == "" {
+		return "", nil, badState.Get("could not infer archive name")
+	}
+	a, ok := archives[name]
+	if !ok {
+		return "", nil, badState.Get("no archive named `" + name + "` is being written")
+	}
+	lastArchive = name
+	return name, a, nil
+}
+
+// entryName cleans up a name for use inside of an archive, which always uses
+// forward slashes and never starts at the root
+func entryName(name string) string {
+	name = path.Clean(filepath.ToSlash(name))
+	name = strings.TrimLeft(name, "/")
+	for strings.HasPrefix(name, "../") {
+		name = name[3:]
+	}
+	if name == ".." || name == "." {
+		return ""
+	}
+	return name
+}
+
+func fArchiveAdd(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	// directories are added with everything in them
+	prefix := filepath.Base(fileName)
+	if len(args) >= 2 {
+		prefix = args[1].String()
+	}
+	prefix = entryName(prefix)
+	archiveName, a, err := archiveArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("adding to archive", lang.F("file", fileName), lang.F("archive", archiveName))
+
+	count := 0
+	err = filepath.WalkDir(fileName, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fileName, p)
+		if err != nil {
+			return err
+		}
+		name := entryName(path.Join(prefix, filepath.ToSlash(rel)))
+		if name == "" {
+			return nil
+		}
+		lang.Log.Debug("adding archive entry", lang.F("entry", name), lang.F("archive", archiveName))
+		count++
+		return a.add(name, p, info)
+	})
+	return lang.NewInt(count), err
+}
+
+func fArchiveClose(args []*lang.Object) (*lang.Object, error) {
+	name, a, err := archiveArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("finishing archive", lang.F("archive", name))
+
+	archivesLock.Lock()
+	delete(archives, name)
+	if lastArchive == name {
+		lastArchive = ""
+	}
+	archivesLock.Unlock()
+	return lang.NewNil(), a.Close()
+}
+
+// closeArchives finishes archives the script left open, returning their
+// names
+func closeArchives() []string {
+	archivesLock.Lock()
+	open := archives
+	archives = make(map[string]archive)
+	lastArchive = ""
+	archivesLock.Unlock()
+	names := []string{}
+	for name, a := range open {
+		a.Close()
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fZipCreate(args []*lang.Object) (*lang.Object, error) {
+	return createArchive(args, func(f *os.File) archive {
+		return &zipArchive{f, zip.NewWriter(f)}
+	})
+}
+
+// fTarCreate creates a tar archive, compressed with gzip if the file name
+// ends with .gz or .tgz
+func fTarCreate(args []*lang.Object) (*lang.Object, error) {
+	return createArchive(args, func(f *os.File) archive {
+		a := &tarArchive{f: f}
+		if isGzipName(f.Name()) {
+			a.gz = gzip.NewWriter(f)
+			a.w = tar.NewWriter(a.gz)
+		} else {
+			a.w = tar.NewWriter(f)
+		}
+		return a
+	})
+}
+
+// archiveEntry describes an entry of an archive being read
+type archiveEntry struct {
+	name string
+	mode fs.FileMode
+	size int64
+	// mtime is in seconds since the unix epoch
+	mtime int64
+	link  string
+	open  func() (io.Reader, error)
+}
+
+func (e *archiveEntry) object() *lang.Object {
+	return lang.NewMap(map[string]*lang.Object{
+		"name":  lang.NewStr(e.name),
+		"size":  lang.NewInt(int(e.size)),
+		"dir":   lang.NewBool(e.mode.IsDir()),
+		"mtime": lang.NewInt(int(e.mtime)),
+	})
+}
+
+// readZip calls fn for every entry of a zip archive, until it returns false
+func readZip(fileName string, fn func(e *archiveEntry) (bool, error)) error {
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		f := f
+		e := &archiveEntry{
+			name:  f.Name,
+			mode:  f.Mode(),
+			size:  int64(f.UncompressedSize64),
+			mtime: f.Modified.Unix(),
+		}
+		e.open = func() (io.Reader, error) {
+			return f.Open()
+		}
+		if e.mode&fs.ModeSymlink != 0 {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			target, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			e.link = string(target)
+		}
+		more, err := fn(e)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// openTar opens a tar archive for reading, along with what has to be closed
+// once done. Archives compressed with gzip are recognised by their contents.
+func openTar(fileName string) (*tar.Reader, []io.Closer, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), []io.Closer{f, gz}, nil
+	}
+	return tar.NewReader(br), []io.Closer{f}, nil
+}
+
+// readTar calls fn for every entry of a tar archive, until it returns false
+func readTar(fileName string, fn func(e *archiveEntry) (bool, error)) error {
+	tr, closers, err := openTar(fileName)
+	if err != nil {
+		return err
+	}
+	defer (&ArchiveEntryStream{closers: closers}).Close()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			name:  hdr.Name,
+			mode:  hdr.FileInfo().Mode(),
+			size:  hdr.Size,
+			mtime: hdr.ModTime.Unix(),
+			link:  hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			return badArg.Get("hard links are not supported: " + hdr.Name)
+		}
+		e.open = func() (io.Reader, error) {
+			return tr, nil
+		}
+		more, err := fn(e)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// safeTarget finds where an entry is extracted to, making sure it stays
+// inside of the destination directory
+func safeTarget(dest, name string) (string, error) {
+	slashed := filepath.ToSlash(name)
+	if slashed == "" || path.IsAbs(slashed) || filepath.IsAbs(name) ||
+		strings.Contains("/"+slashed+"/", "/../") {
+		return "", badArg.Get("archive entry escapes the destination: " + name)
+	}
+	return filepath.Join(dest, filepath.FromSlash(slashed)), nil
+}
+
+// realInside makes sure a path stays inside of the destination directory
+// once links extracted before are followed, which checking the names of
+// entries alone can't tell
+func realInside(dest, p string) (string, error) {
+	real := resolvePath(p)
+	rel, err := filepath.Rel(resolvePath(dest), real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", badArg.Get("archive entry escapes the destination: " + p)
+	}
+	return real, nil
+}
+
+func extractEntry(dest string, e *archiveEntry) error {
+	target, err := safeTarget(dest, e.name)
+	if err != nil {
+		return err
+	}
+	if err := allowWrite(target); err != nil {
+		return err
+	}
+	lang.Log.Debug("extracting archive entry", lang.F("entry", e.name), lang.F("file", target))
+	switch {
+	case e.mode.IsDir():
+		if _, err := realInside(dest, target); err != nil {
+			return err
+		}
+		return os.MkdirAll(target, 0o755)
+	case e.mode&fs.ModeSymlink != 0:
+		parent, err := realInside(dest, filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		// links may only point to somewhere else inside of the destination
+		linked := e.link
+		if !filepath.IsAbs(linked) {
+			linked = filepath.Join(parent, linked)
+		}
+		if _, err := realInside(dest, linked); err != nil {
+			return badArg.Get("archive link escapes the destination: " + e.name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		return os.Symlink(e.link, target)
+	case e.mode.IsRegular():
+		if _, err := realInside(dest, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		r, err := e.open()
+		if err != nil {
+			return err
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		// an existing link in place of the file is not followed either
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|oNoFollow, e.mode.Perm()|0o200)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	// devices, pipes and such are skipped
+	return nil
+}
+
+func listArchive(args []*lang.Object, read func(string, func(*archiveEntry) (bool, error)) error) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "archive file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	entries := []*lang.Object{}
+	err = read(fileName, func(e *archiveEntry) (bool, error) {
+		entries = append(entries, e.object())
+		return true, nil
+	})
+	return lang.NewList(entries), err
+}
+
+func extractArchive(args []*lang.Object, read func(string, func(*archiveEntry) (bool, error)) error) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "archive file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	dest := "."
+	if len(args) >= 2 {
+		dest = args[1].String()
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowWrite(dest); err != nil {
+		return lang.NewNil(), err
+	}
+	if dest, err = filepath.Abs(dest); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("extracting archive", lang.F("file", fileName), lang.F("dir", dest))
+
+	count := 0
+	err = read(fileName, func(e *archiveEntry) (bool, error) {
+		count++
+		return true, extractEntry(dest, e)
+	})
+	return lang.NewInt(count), err
+}
+
+// ArchiveEntryStream reads a single entry of an archive
+type ArchiveEntryStream struct {
+	r       io.Reader
+	closers []io.Closer
+}
+
+func (s *ArchiveEntryStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *ArchiveEntryStream) Write(p []byte) (int, error) {
+	return 0, badState.Get("cannot write to an archive entry")
+}
+
+func (s *ArchiveEntryStream) Seek(offset int64, whence int) (int64, error) {
+	return 0, badState.Get("cannot seek in an archive entry")
+}
+
+func (s *ArchiveEntryStream) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if cErr := s.closers[i].Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// openEntry registers a stream reading the given entry of an archive
+func openEntry(args []*lang.Object, open func(fileName, entry string) (*ArchiveEntryStream, error)) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "archive file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	entry, err := strArg(args, 1, "entry name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	var streamName string
+	if len(args) >= 3 {
+		streamName = args[2].String()
+	} else {
+		streamName = newStreamName("entry")
+	}
+
+	lang.Log.Info("opening archive entry", lang.F("file", fileName),
+		lang.F("entry", entry), lang.F("stream", streamName))
+
+	s, err := open(fileName, entryName(entry))
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	addStream(streamName, s)
+	return lang.NewStr(streamName), nil
+}
+
+func fZipList(args []*lang.Object) (*lang.Object, error) {
+	return listArchive(args, readZip)
+}
+
+func fTarList(args []*lang.Object) (*lang.Object, error) {
+	return listArchive(args, readTar)
+}
+
+func fZipExtract(args []*lang.Object) (*lang.Object, error) {
+	return extractArchive(args, readZip)
+}
+
+func fTarExtract(args []*lang.Object) (*lang.Object, error) {
+	return extractArchive(args, readTar)
+}
+
+func fZipOpenEntry(args []*lang.Object) (*lang.Object, error) {
+	return openEntry(args, func(fileName, entry string) (*ArchiveEntryStream, error) {
+		r, err := zip.OpenReader(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if entryName(f.Name) != entry || f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			return &ArchiveEntryStream{rc, []io.Closer{r, rc}}, nil
+		}
+		r.Close()
+		return nil, badArg.Get("no entry named " + entry)
+	})
+}
+
+func fTarOpenEntry(args []*lang.Object) (*lang.Object, error) {
+	return openEntry(args, func(fileName, entry string) (*ArchiveEntryStream, error) {
+		tr, closers, err := openTar(fileName)
+		if err != nil {
+			return nil, err
+		}
+		s := &ArchiveEntryStream{closers: closers}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				s.Close()
+				return nil, badArg.Get("no entry named " + entry)
+			}
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			if entryName(hdr.Name) == entry && hdr.Typeflag == tar.TypeReg {
+				s.r = tr
+				return s, nil
+			}
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"mohazit/lang"
+	"strconv"
+	"strings"
+)
+
+// packField is a single field of a pack format
+type packField struct {
+	// kind is one of u, i, f (numbers), s (fixed-length string) or p
+	// (length-prefixed string, str in formats)
+	kind  byte
+	size  int
+	order binary.ByteOrder
+}
+
+// parsePackFormat reads a pack format: space-separated fields, with `le` and
+// `be` switching the byte order of the fields after them. Fields are numbers
+// (u8, u16, u32, u64, i8, i16, i32, i64, f32, f64), fixed-length strings (s4
+// is 4 bytes, padded with zeros) and strings prefixed by their length (str8,
+// str16, str32). The default byte order is big endian.
+func parsePackFormat(format string) ([]packField, error) {
+	var order binary.ByteOrder = binary.BigEndian
+	fields := []packField{}
+	for _, word := range strings.Fields(strings.ToLower(format)) {
+		switch word {
+		case "le":
+			order = binary.LittleEndian
+			continue
+		case "be":
+			order = binary.BigEndian
+			continue
+		}
+		var f packField
+		var sizeText string
+		switch {
+		case strings.HasPrefix(word, "str"):
+			f.kind = 'p'
+			sizeText = word[3:]
+		case word[0] == 'u' || word[0] == 'i' || word[0] == 'f' || word[0] == 's':
+			f.kind = word[0]
+			sizeText = word[1:]
+		default:
+			return nil, badArg.Get("unknown pack field " + word)
+		}
+		size, err := strconv.Atoi(sizeText)
+		if err != nil || size < 1 {
+			return nil, badArg.Get("bad size in pack field " + word)
+		}
+		f.order = order
+		switch f.kind {
+		case 'u', 'i', 'p':
+			if size != 8 && size != 16 && size != 32 && (size != 64 || f.kind == 'p') {
+				return nil, badArg.Get(fmt.Sprintf("no %d-bit integer fields", size))
+			}
+			f.size = size / 8
+		case 'f':
+			if size != 32 && size != 64 {
+				return nil, badArg.Get(fmt.Sprintf("no %d-bit float fields", size))
+			}
+			f.size = size / 8
+		case 's':
+			f.size = size
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func putUint(buf []byte, order binary.ByteOrder, v uint64) {
+	switch len(buf) {
+	case 1:
+		buf[0] = byte(v)
+	case 2:
+		order.PutUint16(buf, uint16(v))
+	case 4:
+		order.PutUint32(buf, uint32(v))
+	case 8:
+		order.PutUint64(buf, v)
+	}
+}
+
+func getUint(buf []byte, order binary.ByteOrder) uint64 {
+	switch len(buf) {
+	case 1:
+		return uint64(buf[0])
+	case 2:
+		return uint64(order.Uint16(buf))
+	case 4:
+		return uint64(order.Uint32(buf))
+	}
+	return order.Uint64(buf)
+}
+
+// bytesOf returns the binary data of an object, with anything that isn't
+// bytes used as text
+func bytesOf(o *lang.Object) []byte {
+	if o.Type == lang.ObjBytes {
+		return o.BytesV
+	}
+	return []byte(o.String())
+}
+
+func fPack(args []*lang.Object) (*lang.Object, error) {
+	format, err := strArg(args, 0, "format")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	fields, err := parsePackFormat(format)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	values := args[1:]
+	if len(values) != len(fields) {
+		return lang.NewNil(), badArg.Get(fmt.Sprintf(
+			"format has %d fields, but got %d values", len(fields), len(values)))
+	}
+	out := []byte{}
+	for i, f := range fields {
+		v := values[i]
+		switch f.kind {
+		case 'u', 'i':
+			if v.Type != lang.ObjInt {
+				return lang.NewNil(), badType.Get(fmt.Sprintf("value %d must be an integer", i))
+			}
+			bits := uint(f.size * 8)
+			n := int64(v.IntV)
+			if f.kind == 'u' && (n < 0 || (bits < 64 && n >= 1<<bits)) {
+				return lang.NewNil(), badArg.Get(fmt.Sprintf("%d does not fit in u%d", n, bits))
+			}
+			if f.kind == 'i' && bits < 64 && (n < -(1<<(bits-1)) || n >= 1<<(bits-1)) {
+				return lang.NewNil(), badArg.Get(fmt.Sprintf("%d does not fit in i%d", n, bits))
+			}
+			buf := make([]byte, f.size)
+			putUint(buf, f.order, uint64(n))
+			out = append(out, buf...)
+		case 'f':
+			var x float64
+			switch v.Type {
+			case lang.ObjFloat:
+				x = v.FloatV
+			case lang.ObjInt:
+				x = float64(v.IntV)
+			default:
+				return lang.NewNil(), badType.Get(fmt.Sprintf("value %d must be a number", i))
+			}
+			buf := make([]byte, f.size)
+			if f.size == 4 {
+				f.order.PutUint32(buf, math.Float32bits(float32(x)))
+			} else {
+				f.order.PutUint64(buf, math.Float64bits(x))
+			}
+			out = append(out, buf...)
+		case 's':
+			data := bytesOf(v)
+			if len(data) > f.size {
+				return lang.NewNil(), badArg.Get(fmt.Sprintf(
+					"value %d is longer than %d bytes", i, f.size))
+			}
+			buf := make([]byte, f.size)
+			copy(buf, data)
+			out = append(out, buf...)
+		case 'p':
+			data := bytesOf(v)
+			if f.size < 8 && uint64(len(data)) >= 1<<(uint(f.size)*8) {
+				return lang.NewNil(), badArg.Get(fmt.Sprintf(
+					"value %d is too long for a %d-bit length", i, f.size*8))
+			}
+			buf := make([]byte, f.size)
+			putUint(buf, f.order, uint64(len(data)))
+			out = append(out, buf...)
+			out = append(out, data...)
+		}
+	}
+	return lang.NewBytes(out), nil
+}
+
+func fUnpack(args []*lang.Object) (*lang.Object, error) {
+	format, err := strArg(args, 0, "format")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need data to unpack")
+	}
+	fields, err := parsePackFormat(format)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	data := bytesOf(args[1])
+	take := func(n int) ([]byte, error) {
+		if len(data) < n {
+			return nil, badArg.Get("data is too short for the format")
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+	out := make([]*lang.Object, len(fields))
+	for i, f := range fields {
+		buf, err := take(f.size)
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		switch f.kind {
+		case 'u':
+			n := getUint(buf, f.order)
+			if n > math.MaxInt64 {
+				return lang.NewNil(), badArg.Get(fmt.Sprintf("field %d is too large", i))
+			}
+			out[i] = lang.NewInt(int(n))
+		case 'i':
+			// sign extend from the field size
+			shift := uint(64 - f.size*8)
+			out[i] = lang.NewInt(int(int64(getUint(buf, f.order)<<shift) >> shift))
+		case 'f':
+			if f.size == 4 {
+				out[i] = lang.NewFloat(float64(math.Float32frombits(f.order.Uint32(buf))))
+			} else {
+				out[i] = lang.NewFloat(math.Float64frombits(f.order.Uint64(buf)))
+			}
+		case 's':
+			out[i] = lang.NewStr(strings.TrimRight(string(buf), "\x00"))
+		case 'p':
+			s, err := take(int(getUint(buf, f.order)))
+			if err != nil {
+				return lang.NewNil(), err
+			}
+			out[i] = lang.NewStr(string(s))
+		}
+	}
+	if len(data) > 0 {
+		return lang.NewNil(), badArg.Get(fmt.Sprintf("%d bytes left after unpacking", len(data)))
+	}
+	return lang.NewList(out), nil
+}
+
+// fPackSize returns how many bytes a format takes, so that exactly that much
+// can be read from a stream
+func fPackSize(args []*lang.Object) (*lang.Object, error) {
+	format, err := strArg(args, 0, "format")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	fields, err := parsePackFormat(format)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	size := 0
+	for _, f := range fields {
+		if f.kind == 'p' {
+			return lang.NewNil(), badArg.Get("length-prefixed strings have no fixed size")
+		}
+		size += f.size
+	}
+	return lang.NewInt(size), nil
+}
+
+func fBytes(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	return lang.NewBytes(bytesOf(args[0])), nil
+}
+
+func fBytesStr(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	return lang.NewStr(string(bytesOf(args[0]))), nil
+}
+
+func fBytesLen(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	return lang.NewInt(len(bytesOf(args[0]))), nil
+}
+
+func fHexEncode(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	return lang.NewStr(hex.EncodeToString(bytesOf(args[0]))), nil
+}
+
+func fHexDecode(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "hex text")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return lang.NewNil(), badArg.Get("invalid hex: " + err.Error())
+	}
+	return lang.NewBytes(data), nil
+}
+
+func fBase64Encode(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	return lang.NewStr(base64.StdEncoding.EncodeToString(bytesOf(args[0]))), nil
+}
+
+func fBase64Decode(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "base64 text")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return lang.NewNil(), badArg.Get("invalid base64: " + err.Error())
+	}
+	return lang.NewBytes(data), nil
+}
+
+func fDataReadBytes(args []*lang.Object) (*lang.Object, error) {
+	data, err := readUpTo(args)
+	if data == nil || err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBytes(data), nil
+}
+
+// fDataReadExactBytes reads exactly the given amount of bytes, like a header
+// sized with pack-size
+func fDataReadExactBytes(args []*lang.Object) (*lang.Object, error) {
+	data, err := readExact(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBytes(data), nil
+}
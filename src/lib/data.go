@@ -1,11 +1,14 @@
 package lib
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"mohazit/lang"
 	"os"
+	"strings"
+	"sync"
 )
 
 type Stream interface {
@@ -19,67 +22,343 @@ var streams = make(map[string]Stream)
 var streamsSoFar = 1
 var lastStream = ""
 
-func fDataRead(args []*lang.Object) (*lang.Object, error) {
-	if len(args) < 1 {
-		return lang.NewNil(), moreArgs.Get("need input")
-	}
-	arg := args[0]
-	var amt int
+// readers buffer reads from streams, so that reading up to a delimiter
+// doesn't lose what comes after it. They are created when first needed.
+var readers = make(map[string]*bufio.Reader)
+
+// streamsLock guards the stream registry, which is shared by all tasks. The
+// streams themselves are not safe to use from several tasks at once.
+var streamsLock sync.Mutex
+
+// newStreamName returns an unused stream name starting with the given prefix
+func newStreamName(prefix string) string {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	name := fmt.Sprintf("%s%d", prefix, streamsSoFar)
+	streamsSoFar++
+	return name
+}
+
+// addStream registers a stream and makes it the last used one
+func addStream(name string, stream Stream) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	streams[name] = stream
+	delete(readers, name)
+	lastStream = name
+}
+
+// getStream looks up a stream without making it the last used one
+func getStream(name string) (Stream, bool) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	stream, ok := streams[name]
+	return stream, ok
+}
+
+// removeStream unregisters a stream, without closing it
+func removeStream(name string) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	delete(streams, name)
+	delete(readers, name)
+}
+
+// streamArg resolves the stream named by the i-th argument, falling back to
+// the last used stream if there is no such argument
+func streamArg(args []*lang.Object, i int) (string, Stream, error) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
 	var streamName string
-	if arg.Type != lang.ObjInt {
-		return nil, badType.Get("amount must be an integer")
+	if len(args) > i {
+		var streamObj = args[i]
+		if streamObj.Type != lang.ObjStr {
+			return "", nil, badType.Get("stream name must be a string")
+		}
+		streamName = streamObj.StrV
+	} else {
+		if lastStream == "" {
+			return "", nil, badState.Get("could not infer stream name")
+		}
+		streamName = lastStream
 	}
-	amt = arg.IntV
-	streamName = lastStream
 	stream, ok := streams[streamName]
 	if !ok {
-		return nil, badState.Get("no stream named " + streamName + " is open")
+		return "", nil, badState.Get("no stream named " + streamName + " is open")
+	}
+	lastStream = streamName
+	return streamName, stream, nil
+}
+
+// readerArg resolves the stream named by the i-th argument like streamArg,
+// returning the buffered reader for it
+func readerArg(args []*lang.Object, i int) (string, *bufio.Reader, error) {
+	streamName, stream, err := streamArg(args, i)
+	if err != nil {
+		return "", nil, err
+	}
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	r, ok := readers[streamName]
+	if !ok {
+		r = bufio.NewReader(stream)
+		readers[streamName] = r
+	}
+	return streamName, r, nil
+}
+
+// unbuffer gives what was read ahead from a stream back to it before it is
+// written to or seeked in, since the position would be off otherwise. Streams
+// that can't seek keep their reader, as reading and writing them is
+// independent.
+func unbuffer(streamName string, stream Stream) {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	r, ok := readers[streamName]
+	if !ok {
+		return
+	}
+	if n := r.Buffered(); n > 0 {
+		if _, err := stream.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return
+		}
+	}
+	delete(readers, streamName)
+}
+
+// bufferedReader returns the reader for a stream if it has one, so that data
+// read ahead isn't skipped
+func bufferedReader(streamName string, stream Stream) io.Reader {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+	if r, ok := readers[streamName]; ok {
+		return r
+	}
+	return stream
+}
+
+// readResult turns read data into a string, or nil if the stream ended before
+// anything was read
+func readResult(data []byte, err error) (*lang.Object, error) {
+	if err == io.EOF {
+		if len(data) == 0 {
+			return lang.NewNil(), nil
+		}
+		err = nil
+	}
+	if err != nil {
+		return lang.NewNil(), err
 	}
+	return lang.NewStr(string(data)), nil
+}
 
-	fmt.Printf("reading %d byte(s) from stream `%s`\n", amt, streamName)
+// arrivesOverTime tells if the data of a stream comes in as the other side
+// sends it, rather than all being there already
+func arrivesOverTime(s Stream) bool {
+	switch s.(type) {
+	case *NetConnStream, *PipeStream, *ResponseStream:
+		return true
+	}
+	return false
+}
 
+// readUpTo reads at most the amount of bytes given by the first argument from
+// the stream given by the second one. Files and buffers are read until the
+// amount or their end is reached, while sockets, pipes and responses give
+// what has arrived, waiting only if nothing has. It returns nil data at the
+// end of the stream.
+func readUpTo(args []*lang.Object) ([]byte, error) {
+	amt, err := intArg(args, 0, "amount")
+	if err != nil {
+		return nil, err
+	}
+	if amt < 0 {
+		return nil, badArg.Get("amount must not be negative")
+	}
+	streamName, r, err := readerArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	stream, _ := getStream(streamName)
+
+	lang.Log.Debug("reading", lang.F("stream", streamName), lang.F("bytes", amt))
+
+	if amt == 0 {
+		return []byte{}, nil
+	}
+	if !arrivesOverTime(stream) {
+		// the buffer grows as the data is read, rather than all at once
+		var buf lang.Buffer
+		defer buf.Release()
+		n, err := io.CopyN(&buf, r, int64(amt))
+		if err == io.EOF {
+			if n == 0 {
+				return nil, nil
+			}
+			err = nil
+		}
+		return buf.Bytes(), err
+	}
+	// waiting for data first means only what arrived is set aside, rather
+	// than everything asked for
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if held := r.Buffered(); held < amt {
+		amt = held
+	}
+	if err := lang.Reserve(amt); err != nil {
+		return nil, err
+	}
+	defer lang.Release(amt)
 	data := make([]byte, amt)
-	_, err := stream.Read(data)
+	n, err := r.Read(data)
+	return data[:n], err
+}
+
+// readExact reads exactly the amount of bytes given by the first argument,
+// failing if the stream ends before that
+func readExact(args []*lang.Object) ([]byte, error) {
+	amt, err := intArg(args, 0, "amount")
+	if err != nil {
+		return nil, err
+	}
+	if amt < 0 {
+		return nil, badArg.Get("amount must not be negative")
+	}
+	streamName, r, err := readerArg(args, 1)
 	if err != nil {
 		return nil, err
 	}
+
+	lang.Log.Debug("reading", lang.F("stream", streamName), lang.F("bytes", amt))
+
+	// the buffer grows as the data arrives, rather than all at once
+	var buf lang.Buffer
+	defer buf.Release()
+	n, err := io.CopyN(&buf, r, int64(amt))
+	if err == io.EOF {
+		return nil, badState.Get(fmt.Sprintf(
+			"stream %s ended after %d of %d bytes", streamName, n, amt))
+	}
+	return buf.Bytes(), err
+}
+
+func fDataRead(args []*lang.Object) (*lang.Object, error) {
+	data, err := readUpTo(args)
+	if data == nil || err != nil {
+		return lang.NewNil(), err
+	}
 	return lang.NewStr(string(data)), nil
 }
 
+// fDataReadLine reads up to the end of the line, without the line ending
+func fDataReadLine(args []*lang.Object) (*lang.Object, error) {
+	streamName, r, err := readerArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("reading line", lang.F("stream", streamName))
+
+	line, err := r.ReadString('\n')
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if err == io.EOF && line == "" {
+		return lang.NewNil(), nil
+	}
+	return readResult([]byte(line), err)
+}
+
+// fDataReadUntil reads up to the given delimiter, which is consumed but not
+// included in the result. Reading also stops at the end of the stream.
+func fDataReadUntil(args []*lang.Object) (*lang.Object, error) {
+	delim, err := strArg(args, 0, "delimiter")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if delim == "" {
+		return lang.NewNil(), badArg.Get("delimiter must not be empty")
+	}
+	streamName, r, err := readerArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("reading until delimiter", lang.F("stream", streamName), lang.F("delim", delim))
+
+	last := delim[len(delim)-1]
+	data := []byte{}
+	for {
+		chunk, err := r.ReadBytes(last)
+		data = append(data, chunk...)
+		if err != nil {
+			return readResult(data, err)
+		}
+		if bytes.HasSuffix(data, []byte(delim)) {
+			return lang.NewStr(string(data[:len(data)-len(delim)])), nil
+		}
+	}
+}
+
+func fDataReadAll(args []*lang.Object) (*lang.Object, error) {
+	streamName, r, err := readerArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("reading everything", lang.F("stream", streamName))
+
+	data, err := lang.ReadAll(r)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(string(data)), nil
+}
+
+// fDataReadExact reads exactly the given amount of bytes, failing if the
+// stream ends before that
+func fDataReadExact(args []*lang.Object) (*lang.Object, error) {
+	data, err := readExact(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(string(data)), nil
+}
+
+func fDataEOF(args []*lang.Object) (*lang.Object, error) {
+	_, r, err := readerArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	_, err = r.Peek(1)
+	if err == io.EOF {
+		return lang.NewBool(true), nil
+	}
+	return lang.NewBool(false), err
+}
+
 func fDataWrite(args []*lang.Object) (*lang.Object, error) {
 	var data []byte
-	var streamName string
 	if len(args) < 1 {
 		return lang.NewNil(), moreArgs.Get("need data to write")
 	}
-	data = []byte(args[0].String())
-	if len(args) >= 2 {
-		var streamObj = args[1]
-		if streamObj.Type != lang.ObjStr {
-			return lang.NewNil(), badType.Get("stream name must be a string")
-		}
-		streamName = streamObj.StrV
-	} else {
-		if lastStream == "" {
-			return lang.NewNil(), badState.Get("could not infer stream name")
-		}
-		streamName = lastStream
-	}
-	lastStream = streamName
-	stream, ok := streams[streamName]
-	if !ok {
-		return lang.NewNil(), badState.Get("no stream named " + streamName + " is open")
+	data = bytesOf(args[0])
+	streamName, stream, err := streamArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
 	}
 
-	fmt.Printf("writing %d byte(s) to stream `%s`\n", len(data), streamName)
+	lang.Log.Debug("writing", lang.F("stream", streamName), lang.F("bytes", len(data)))
 
-	_, err := stream.Write(data)
+	unbuffer(streamName, stream)
+	_, err = stream.Write(data)
 	return lang.NewNil(), err
 }
 
 func fDataSeek(args []*lang.Object) (*lang.Object, error) {
 	var pos int
-	var streamName string
 	if len(args) < 1 {
 		return lang.NewNil(), moreArgs.Get("need data to write")
 	}
@@ -88,57 +367,42 @@ func fDataSeek(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("position must be an integer")
 	}
 	pos = posObj.IntV
-	if len(args) >= 2 {
-		var streamObj = args[1]
-		if streamObj.Type != lang.ObjStr {
-			return lang.NewNil(), badType.Get("stream name must be a string")
-		}
-		streamName = streamObj.StrV
-	} else {
-		if lastStream == "" {
-			return lang.NewNil(), badState.Get("could not infer stream name")
-		}
-		streamName = lastStream
-	}
-	lastStream = streamName
-	stream, ok := streams[streamName]
-	if !ok {
-		return lang.NewNil(), badState.Get("no stream named " + streamName + " is open")
+	streamName, stream, err := streamArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
 	}
 
-	fmt.Printf("seeking to position %d in stream `%s`\n", pos, streamName)
+	lang.Log.Debug("seeking", lang.F("stream", streamName), lang.F("pos", pos))
 
-	_, err := stream.Seek(int64(pos), 0)
+	unbuffer(streamName, stream)
+	_, err = stream.Seek(int64(pos), 0)
 	return lang.NewInt(pos), err
 }
 
 func fDataClose(args []*lang.Object) (*lang.Object, error) {
-	var streamName string
-	if len(args) >= 1 {
-		var streamObj = args[0]
-		if streamObj.Type != lang.ObjStr {
-			return lang.NewNil(), badType.Get("stream name must be a string")
-		}
-		streamName = streamObj.StrV
-	} else {
-		if lastStream == "" {
-			return lang.NewNil(), badState.Get("could not infer stream name")
-		}
-		streamName = lastStream
-	}
-	lastStream = streamName
-	stream, ok := streams[streamName]
-	if !ok {
-		return lang.NewNil(), badState.Get("no stream named " + streamName + " is open")
+	streamName, stream, err := streamArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
 	}
 
-	fmt.Printf("closing stream `%s`\n", streamName)
+	lang.Log.Info("closing stream", lang.F("stream", streamName))
 
 	stream.Close()
-	delete(streams, streamName)
+	removeStream(streamName)
 	return lang.NewNil(), nil
 }
 
+// openModes are the ways files can be opened, with update (reading and
+// writing an existing file) being the default
+var openModes = map[string]int{
+	"update":    os.O_RDWR,
+	"read":      os.O_RDONLY,
+	"write":     os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"append":    os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"create":    os.O_RDWR | os.O_CREATE,
+	"exclusive": os.O_RDWR | os.O_CREATE | os.O_EXCL,
+}
+
 func fFileOpen(args []*lang.Object) (*lang.Object, error) {
 	var fileName string
 	var streamName string
@@ -150,33 +414,47 @@ func fFileOpen(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("file name must be a string")
 	}
 	fileName = fileObj.StrV
-	streamName = fmt.Sprintf("filestream%d", streamsSoFar)
-	streamsSoFar++
+	mode := "update"
+	if len(args) >= 2 {
+		mode = args[1].String()
+	}
+	flags, ok := openModes[mode]
+	if !ok {
+		return lang.NewNil(), badArg.Get("unknown file mode " + mode)
+	}
+	if flags&os.O_WRONLY == 0 {
+		if err := allowRead(fileName); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := allowWrite(fileName); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	streamName = newStreamName("filestream")
 
-	fmt.Printf("opening file `%s` to stream `%s`\n", fileName, streamName)
+	lang.Log.Info("opening file", lang.F("file", fileName), lang.F("stream", streamName), lang.F("mode", mode))
 
-	file, err := os.OpenFile(fileName, os.O_RDWR, os.ModePerm)
+	file, err := os.OpenFile(fileName, flags, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	streams[streamName] = file
-	lastStream = streamName
+	addStream(streamName, file)
 	return lang.NewStr(streamName), nil
 }
 
 func fBufCreate(args []*lang.Object) (*lang.Object, error) {
 	var streamName string
 	if len(args) == 0 {
-		streamName = fmt.Sprintf("buffer%d", streamsSoFar)
+		streamName = newStreamName("buffer")
 	} else {
 		streamName = args[0].String()
 	}
-	streamsSoFar++
 
-	fmt.Printf("opening stream `%s`\n", streamName)
+	lang.Log.Info("opening buffer", lang.F("stream", streamName))
 
-	streams[streamName] = &GenericStream{}
-	lastStream = streamName
+	addStream(streamName, &GenericStream{})
 	return lang.NewStr(streamName), nil
 }
 
@@ -197,21 +475,21 @@ func fDataCopy(args []*lang.Object) (*lang.Object, error) {
 	}
 	toName = t.StrV
 
-	fromStream, ok := streams[fromName]
+	fromStream, ok := getStream(fromName)
 	if !ok {
 		return lang.NewNil(), badState.Get("could not find stream " + fromName)
 	}
-	toStream, ok := streams[toName]
+	toStream, ok := getStream(toName)
 	if !ok {
 		return lang.NewNil(), badState.Get("could not find stream " + toName)
 	}
 
-	data, err := io.ReadAll(fromStream)
-	if err != io.EOF && err != nil {
-		return lang.NewNil(), err
-	}
-	n, err := toStream.Write(data)
-	return lang.NewObject(n), err
+	lang.Log.Debug("copying", lang.F("from", fromName), lang.F("to", toName))
+
+	unbuffer(toName, toStream)
+	// copied in chunks, so that large files don't have to fit in memory
+	n, err := io.Copy(toStream, bufferedReader(fromName, fromStream))
+	return lang.NewInt(int(n)), err
 }
 
 type DummyStream struct{}
@@ -259,6 +537,9 @@ type GenericStream struct {
 }
 
 func (s *GenericStream) Read(p []byte) (int, error) {
+	if s.pos >= len(s.data) && len(p) > 0 {
+		return 0, io.EOF
+	}
 	var i = 0
 	for s.pos < len(s.data) && i < len(p) {
 		p[i] = s.data[s.pos]
@@ -269,6 +550,16 @@ func (s *GenericStream) Read(p []byte) (int, error) {
 }
 
 func (s *GenericStream) Write(p []byte) (int, error) {
+	// only the part written past the end grows the buffer
+	start := s.pos
+	if start > len(s.data) {
+		start = len(s.data)
+	}
+	if grow := start + len(p) - len(s.data); grow > 0 {
+		if err := lang.Reserve(grow); err != nil {
+			return 0, err
+		}
+	}
 	var i = 0
 	for i < len(p) {
 		if s.pos >= len(s.data) {
@@ -297,6 +588,7 @@ func (s *GenericStream) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (s *GenericStream) Close() error {
+	lang.Release(len(s.data))
 	s.data = []byte{}
 	s.pos = 0
 	return nil
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"mohazit/lang"
+	"os"
+	"sort"
+	"strings"
+)
+
+func fEnvGet(args []*lang.Object) (*lang.Object, error) {
+	if err := allowEnv(); err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need variable name")
+	}
+	nameObj := args[0]
+	if nameObj.Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("variable name must be a string")
+	}
+	v, ok := os.LookupEnv(nameObj.StrV)
+	if !ok {
+		if len(args) >= 2 {
+			return args[1], nil
+		}
+		return lang.NewNil(), nil
+	}
+	return lang.NewStr(v), nil
+}
+
+func fEnvSet(args []*lang.Object) (*lang.Object, error) {
+	if err := allowEnv(); err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need variable name and value")
+	}
+	nameObj := args[0]
+	if nameObj.Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("variable name must be a string")
+	}
+	return lang.NewNil(), os.Setenv(nameObj.StrV, args[1].String())
+}
+
+func fEnvUnset(args []*lang.Object) (*lang.Object, error) {
+	if err := allowEnv(); err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need variable name")
+	}
+	nameObj := args[0]
+	if nameObj.Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("variable name must be a string")
+	}
+	return lang.NewNil(), os.Unsetenv(nameObj.StrV)
+}
+
+func fEnvList(args []*lang.Object) (*lang.Object, error) {
+	if err := allowEnv(); err != nil {
+		return lang.NewNil(), err
+	}
+	names := []string{}
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		// windows has some hidden variables like `=C:`
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return lang.NewObject(names), nil
+}
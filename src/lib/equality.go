@@ -43,21 +43,38 @@ func cLike(a *lang.Object, b *lang.Object) (bool, error) {
 }
 
 func cGreater(a *lang.Object, b *lang.Object) (bool, error) {
-	if a.Type != b.Type {
-		return false, badType.Get("both arguments must be the same type")
+	if a.Type == lang.ObjInt && b.Type == lang.ObjInt {
+		return a.IntV > b.IntV, nil
 	}
-	if a.Type != lang.ObjInt {
-		return false, badType.Get("arguments are not integers, cannot compare")
+	af, bf, err := numericPair(a, b)
+	if err != nil {
+		return false, err
 	}
-	return a.IntV > b.IntV, nil
+	return af > bf, nil
 }
 
 func cLesser(a *lang.Object, b *lang.Object) (bool, error) {
-	if a.Type != b.Type {
-		return false, badType.Get("both arguments must be the same type")
+	if a.Type == lang.ObjInt && b.Type == lang.ObjInt {
+		return a.IntV < b.IntV, nil
 	}
-	if a.Type != lang.ObjInt {
-		return false, badType.Get("arguments are not integers, cannot compare")
+	af, bf, err := numericPair(a, b)
+	if err != nil {
+		return false, err
 	}
-	return a.IntV < b.IntV, nil
+	return af < bf, nil
+}
+
+// numericPair converts two numbers (integers or floats) to floats so they can
+// be compared
+func numericPair(a *lang.Object, b *lang.Object) (float64, float64, error) {
+	if !isNumeric(a) || !isNumeric(b) {
+		return 0, 0, badType.Get("arguments are not numbers, cannot compare")
+	}
+	ac, _ := a.TryConvert(lang.ObjFloat)
+	bc, _ := b.TryConvert(lang.ObjFloat)
+	return ac.FloatV, bc.FloatV, nil
+}
+
+func isNumeric(o *lang.Object) bool {
+	return o.Type == lang.ObjInt || o.Type == lang.ObjFloat
 }
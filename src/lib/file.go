@@ -1,11 +1,15 @@
 package lib
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/fs"
 	"mohazit/lang"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 )
 
 func fFileCreate(args []*lang.Object) (*lang.Object, error) {
@@ -18,8 +22,11 @@ func fFileCreate(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("file name must be a string")
 	}
 	fileName = fileObj.StrV
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
 
-	fmt.Printf("creating file `%s`\n", fileName)
+	lang.Log.Info("creating file", lang.F("file", fileName))
 
 	f, err := os.Create(fileName)
 	if err != nil {
@@ -38,8 +45,11 @@ func fFileDelete(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("file name must be a string")
 	}
 	fileName = fileObj.StrV
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
 
-	fmt.Printf("deleting file `%s`\n", fileName)
+	lang.Log.Info("deleting file", lang.F("file", fileName))
 
 	return lang.NewNil(), os.Remove(fileName)
 }
@@ -60,8 +70,11 @@ func fFileRename(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("file name must be a string")
 	}
 	newName = newObj.StrV
+	if err := allowWrite(oldName, newName); err != nil {
+		return lang.NewNil(), err
+	}
 
-	fmt.Printf("renaming file `%s` to `%s`\n", oldName, newName)
+	lang.Log.Info("renaming file", lang.F("from", oldName), lang.F("to", newName))
 
 	return lang.NewNil(), os.Rename(oldName, newName)
 }
@@ -76,6 +89,9 @@ func fFileExists(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("file name must be a string")
 	}
 	fileName = fileObj.StrV
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
 
 	f, err := os.Open(fileName)
 	if err != nil {
@@ -88,21 +104,22 @@ func fFileExists(args []*lang.Object) (*lang.Object, error) {
 	return lang.NewBool(true), nil
 }
 
+// fWalk changes the working directory to the path made by joining the given
+// segments, returning the new working directory
 func fWalk(args []*lang.Object) (*lang.Object, error) {
-	// TODO(qeaml): join arguments with \ because windows
-	var fileName string
 	if len(args) < 1 {
-		return lang.NewNil(), moreArgs.Get("need file name")
+		return lang.NewNil(), moreArgs.Get("need directory name")
 	}
-	fileObj := args[0]
-	if fileObj.Type != lang.ObjStr {
-		return lang.NewNil(), badType.Get("file name must be a string")
+	segments := make([]string, len(args))
+	for i, o := range args {
+		segments[i] = o.String()
+	}
+	dir := filepath.Join(segments...)
+	if err := allowRead(dir); err != nil {
+		return lang.NewNil(), err
 	}
-	fileName = fileObj.StrV
-
-	fmt.Printf("changing working directory to `%s`\n", fileName)
 
-	err := os.Chdir(fileName)
+	err := os.Chdir(dir)
 	if err != nil {
 		return lang.NewNil(), err
 	}
@@ -111,16 +128,62 @@ func fWalk(args []*lang.Object) (*lang.Object, error) {
 	if err != nil {
 		return lang.NewNil(), err
 	}
-	fmt.Printf("working directory is now `%s`\n", wd)
+	lang.Log.Info("changed working directory", lang.F("dir", wd))
 	return lang.NewStr(wd), nil
 }
 
-func fFileList(args []*lang.Object) (*lang.Object, error) {
+// dirStack holds the directories to return to with popd
+var dirStack = []string{}
+var dirStackLock sync.Mutex
+
+func fPushd(args []*lang.Object) (*lang.Object, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	newWd, err := fWalk(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	dirStackLock.Lock()
+	dirStack = append(dirStack, wd)
+	dirStackLock.Unlock()
+	return newWd, nil
+}
+
+func fPopd(args []*lang.Object) (*lang.Object, error) {
+	dirStackLock.Lock()
+	defer dirStackLock.Unlock()
+	if len(dirStack) == 0 {
+		return lang.NewNil(), badState.Get("directory stack is empty")
+	}
+	dir := dirStack[len(dirStack)-1]
+	wd, err := fWalk([]*lang.Object{lang.NewStr(dir)})
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	dirStack = dirStack[:len(dirStack)-1]
+	return wd, nil
+}
+
+// fFileList prints a table of the current directory, or returns records of
+// the entries of the given directory
+func fFileList(out io.Writer, args []*lang.Object) (*lang.Object, error) {
+	if len(args) >= 1 {
+		dir := args[0].String()
+		if err := allowRead(dir); err != nil {
+			return lang.NewNil(), err
+		}
+		return listDir(dir)
+	}
+	if err := allowRead("."); err != nil {
+		return lang.NewNil(), err
+	}
 	wd, err := os.Getwd()
 	if err != nil {
 		return lang.NewNil(), err
 	}
-	fmt.Printf("Directory of %s\n", wd)
+	fmt.Fprintf(out, "Directory of %s\n", wd)
 	entries, err := os.ReadDir(".")
 	if err != nil {
 		return lang.NewNil(), err
@@ -152,7 +215,7 @@ func fFileList(args []*lang.Object) (*lang.Object, error) {
 			return lang.NewNil(), err
 		}
 		niceTime := di.ModTime().Format("15:04:05 02.01.2006")
-		fmt.Printf("%s(DIR)      %s\n", niceName, niceTime)
+		fmt.Fprintf(out, "%s(DIR)      %s\n", niceName, niceTime)
 	}
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].Name() < files[j].Name()
@@ -176,17 +239,17 @@ func fFileList(args []*lang.Object) (*lang.Object, error) {
 		for len(niceSize) < 10 {
 			niceSize += " "
 		}
-		fmt.Printf("%s%s %s\n", niceName, niceSize, niceTime)
+		fmt.Fprintf(out, "%s%s %s\n", niceName, niceSize, niceTime)
 	}
 	if len(dirs) == 1 {
-		fmt.Print("1 dir, ")
+		fmt.Fprint(out, "1 dir, ")
 	} else {
-		fmt.Printf("%d dirs, ", len(dirs))
+		fmt.Fprintf(out, "%d dirs, ", len(dirs))
 	}
 	if len(files) == 1 {
-		fmt.Print("1 file\n")
+		fmt.Fprint(out, "1 file\n")
 	} else {
-		fmt.Printf("%d files\n", len(files))
+		fmt.Fprintf(out, "%d files\n", len(files))
 	}
 	return lang.NewNil(), nil
 }
@@ -211,3 +274,165 @@ func humanSize(size int64) string {
 	}
 	return fmt.Sprintf("%d B", size)
 }
+
+// readFile reads a whole file, which counts towards the buffer memory limit
+// while reading
+func readFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return lang.ReadAll(f)
+}
+
+func fFileRead(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("reading file", lang.F("file", fileName))
+
+	data, err := readFile(fileName)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(string(data)), nil
+}
+
+func fFileReadBytes(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("reading file", lang.F("file", fileName))
+
+	data, err := readFile(fileName)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBytes(data), nil
+}
+
+// fFileLines reads a file as a list of lines, without their line endings
+func fFileLines(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("reading file", lang.F("file", fileName))
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewObject(lines), nil
+}
+
+// writeFile writes the second argument to the file named by the first one,
+// opened with the given flags
+func writeFile(args []*lang.Object, flags int) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need data to write")
+	}
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	data := bytesOf(args[1])
+
+	lang.Log.Info("writing file", lang.F("file", fileName), lang.F("bytes", len(data)))
+
+	f, err := os.OpenFile(fileName, flags, 0o644)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return lang.NewNil(), err
+	}
+	return lang.NewNil(), f.Close()
+}
+
+func fFileWrite(args []*lang.Object) (*lang.Object, error) {
+	return writeFile(args, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+func fFileAppend(args []*lang.Object) (*lang.Object, error) {
+	return writeFile(args, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+// fFileWriteAtomic writes to a temporary file next to the target and then
+// renames it into place, so the target is never left half-written
+func fFileWriteAtomic(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need data to write")
+	}
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	data := bytesOf(args[1])
+
+	lang.Log.Info("writing file atomically", lang.F("file", fileName), lang.F("bytes", len(data)))
+
+	// the replacement keeps the permissions of the file it replaces
+	perm := fs.FileMode(0o644)
+	if info, err := os.Stat(fileName); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	fail := func(err error) (*lang.Object, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return lang.NewNil(), err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), fileName); err != nil {
+		os.Remove(tmp.Name())
+		return lang.NewNil(), err
+	}
+	return lang.NewNil(), nil
+}
@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mohazit/lang"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fileRecord describes a file, with its modification time in seconds since
+// the unix epoch and its permissions as octal text, like 0644
+func fileRecord(name string, info fs.FileInfo) *lang.Object {
+	return lang.NewMap(map[string]*lang.Object{
+		"name":  lang.NewStr(name),
+		"size":  lang.NewInt(int(info.Size())),
+		"dir":   lang.NewBool(info.IsDir()),
+		"link":  lang.NewBool(info.Mode()&fs.ModeSymlink != 0),
+		"mtime": lang.NewInt(int(info.ModTime().Unix())),
+		"mode":  lang.NewStr(info.Mode().String()),
+		"perm":  lang.NewStr("0" + strconv.FormatUint(uint64(info.Mode().Perm()), 8)),
+	})
+}
+
+// listDir returns records of everything in a directory, sorted by name
+func listDir(dir string) (*lang.Object, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	records := make([]*lang.Object, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		records = append(records, fileRecord(e.Name(), info))
+	}
+	return lang.NewList(records), nil
+}
+
+// copyTree copies a file, link or directory with everything in it, keeping
+// permissions
+func copyTree(from, to string) error {
+	// copying into itself would never run out of things to copy
+	rel, err := filepath.Rel(resolvePath(from), resolvePath(to))
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return badArg.Get("cannot copy " + from + " into itself")
+	}
+	return filepath.WalkDir(from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(from, to string, perm fs.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// parsePerm reads permissions written in octal, like 755 or 0644
+func parsePerm(o *lang.Object) (fs.FileMode, error) {
+	perm, err := strconv.ParseUint(o.String(), 8, 32)
+	if err != nil || perm > 0o7777 {
+		return 0, badArg.Get("permissions must be octal, like 644: " + o.String())
+	}
+	return fs.FileMode(perm), nil
+}
+
+// fDirCreate creates a directory along with any missing parents
+func fDirCreate(args []*lang.Object) (*lang.Object, error) {
+	dir, err := strArg(args, 0, "directory name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	perm := fs.FileMode(0o755)
+	if len(args) >= 2 {
+		if perm, err = parsePerm(args[1]); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	if err := allowWrite(dir); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("creating directory", lang.F("dir", dir))
+
+	return lang.NewNil(), os.MkdirAll(dir, perm)
+}
+
+// fDirRemove removes a directory with everything in it
+func fDirRemove(args []*lang.Object) (*lang.Object, error) {
+	dir, err := strArg(args, 0, "directory name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowWrite(dir); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("removing directory", lang.F("dir", dir))
+
+	return lang.NewNil(), os.RemoveAll(dir)
+}
+
+// fFileCopy copies a file, or a directory with everything in it, to exactly
+// the given path
+func fFileCopy(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need source and destination")
+	}
+	from, to := args[0].String(), args[1].String()
+	if err := allowRead(from); err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowWrite(to); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("copying", lang.F("from", from), lang.F("to", to))
+
+	return lang.NewNil(), copyTree(from, to)
+}
+
+// fFileMove moves a file or directory, also across file systems
+func fFileMove(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need source and destination")
+	}
+	from, to := args[0].String(), args[1].String()
+	if err := allowWrite(from, to); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("moving", lang.F("from", from), lang.F("to", to))
+
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return lang.NewNil(), err
+	}
+	// renaming doesn't work across file systems, so copy and then remove
+	if err := copyTree(from, to); err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewNil(), os.RemoveAll(from)
+}
+
+// fFileStat describes a file, without following links
+func fFileStat(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+	info, err := os.Lstat(fileName)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return fileRecord(filepath.Base(fileName), info), nil
+}
+
+func fFileChmod(args []*lang.Object) (*lang.Object, error) {
+	fileName, err := strArg(args, 0, "file name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need permissions")
+	}
+	perm, err := parsePerm(args[1])
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowWrite(fileName); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("changing permissions", lang.F("file", fileName), lang.F("perm", args[1].String()))
+
+	return lang.NewNil(), os.Chmod(fileName, perm)
+}
+
+// fFileSymlink creates a link at the second path, pointing to the first
+func fFileSymlink(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need target and link name")
+	}
+	target, link := args[0].String(), args[1].String()
+	if err := allowWrite(link); err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("creating link", lang.F("file", link), lang.F("target", target))
+
+	return lang.NewNil(), os.Symlink(target, link)
+}
+
+// fFileGlob returns the sorted paths matching any of the given patterns
+func fFileGlob(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need pattern")
+	}
+	seen := map[string]bool{}
+	matches := []string{}
+	for _, arg := range args {
+		pattern := arg.String()
+		if err := allowRead(filepath.Dir(pattern)); err != nil {
+			return lang.NewNil(), err
+		}
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return lang.NewNil(), badArg.Get("bad pattern " + pattern)
+		}
+		for _, m := range found {
+			// matches the script may not read are left out, as if they
+			// weren't there
+			if allowRead(m) != nil {
+				continue
+			}
+			if !seen[m] {
+				seen[m] = true
+				matches = append(matches, m)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return lang.NewObject(matches), nil
+}
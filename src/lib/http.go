@@ -1,56 +1,488 @@
 package lib
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io"
 	"mohazit/lang"
 	"mohazit/tool"
-
-	"github.com/levigross/grequests"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var client = grequests.NewSession(&grequests.RequestOptions{
-	UserAgent: fmt.Sprintf("Mohazit/%s%d", tool.Version, tool.Iteration),
-})
-var resps = make(map[string]*grequests.Response)
+// HTTPTransport is used to perform HTTP requests. It can be replaced to
+// intercept requests, for example in tests. If nil, http.DefaultTransport is
+// used.
+var HTTPTransport http.RoundTripper
+
+var userAgent = fmt.Sprintf("Mohazit/%s%d", tool.Version, tool.Iteration)
+var cookies, _ = cookiejar.New(nil)
+var resps = make(map[string]*http.Response)
 var respCount = 0
 var lastResp = ""
 
-func fHttpGet(args []*lang.Object) (*lang.Object, error) {
-	if len(args) < 1 {
-		return lang.NewNil(), moreArgs.Get("need input")
+// lastRespClosed is set once the body of the last response is closed. Its
+// status and headers stay available until the next response arrives.
+var lastRespClosed = false
+
+// httpRequest is a request that is being built before it is sent
+type httpRequest struct {
+	method    string
+	url       string
+	header    http.Header
+	query     url.Values
+	body      io.Reader
+	timeout   time.Duration
+	redirects int
+}
+
+var reqs = make(map[string]*httpRequest)
+var reqCount = 0
+var lastReq = ""
+
+// httpLock guards the request and response registries, which are shared by
+// all tasks
+var httpLock sync.Mutex
+
+// maxRedirects is the amount of redirects followed by default, same as
+// net/http's default client
+const maxRedirects = 10
+
+func newRequest(method, target string) *httpRequest {
+	header := make(http.Header)
+	header.Set("User-Agent", userAgent)
+	return &httpRequest{
+		method:    strings.ToUpper(method),
+		url:       target,
+		header:    header,
+		query:     make(url.Values),
+		redirects: maxRedirects,
 	}
-	in := args[0]
-	if in.Type != lang.ObjStr {
-		return nil, badType.Get("URL must be a string")
+}
+
+// send performs the request and registers the response, as well as a stream
+// of the response body
+func (r *httpRequest) send() (*lang.Object, error) {
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return lang.NewNil(), badArg.Get("invalid URL: " + err.Error())
 	}
-	fmt.Printf("sending HTTP request %d: GET %s\n", respCount, in.StrV)
-	resp, err := client.Get(in.StrV, nil)
+	if err := allowURL(u); err != nil {
+		return lang.NewNil(), err
+	}
+	if len(r.query) > 0 {
+		q := u.Query()
+		for k, v := range r.query {
+			q[k] = append(q[k], v...)
+		}
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(lang.Context(), r.method, u.String(), r.body)
 	if err != nil {
-		return nil, err
+		return lang.NewNil(), err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	transport := HTTPTransport
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
+	limit := r.redirects
+	c := &http.Client{
+		Transport: transport,
+		Jar:       cookies,
+		// the timeout also covers reading the body
+		Timeout: r.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if limit <= 0 {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= limit {
+				return badState.Get(fmt.Sprintf("stopped after %d redirects", limit))
+			}
+			return allowURL(req.URL)
+		},
+	}
+	httpLock.Lock()
 	respName := fmt.Sprintf("response%d", respCount)
 	respCount++
+	httpLock.Unlock()
+
+	lang.Log.Info("sending HTTP request", lang.F("response", respName),
+		lang.F("method", r.method), lang.F("url", u))
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	httpLock.Lock()
+	if lastRespClosed {
+		delete(resps, lastResp)
+		lastRespClosed = false
+	}
 	resps[respName] = resp
 	lastResp = respName
-	streams[respName] = &GenericStream{data: resp.Bytes()}
-	lastStream = respName
+	httpLock.Unlock()
+	addStream(respName, &ResponseStream{name: respName, body: resp.Body})
 	return lang.NewStr(respName), nil
 }
 
-func fHttpOk(args []*lang.Object) (*lang.Object, error) {
+// requestArg resolves the request named by the i-th argument, falling back to
+// the last created request
+func requestArg(args []*lang.Object, i int) (*httpRequest, error) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+	reqName := lastReq
+	if len(args) > i {
+		if args[i].Type != lang.ObjStr {
+			return nil, badType.Get("request name must be a string")
+		}
+		reqName = args[i].StrV
+	} else if reqName == "" {
+		return nil, badState.Get("could not infer request name")
+	}
+	req, ok := reqs[reqName]
+	if !ok {
+		return nil, badState.Get("no request named `" + reqName + "` exists")
+	}
+	lastReq = reqName
+	return req, nil
+}
+
+// forgetRequest removes a request that has been sent from the registry
+func forgetRequest(req *httpRequest) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+	for name, r := range reqs {
+		if r == req {
+			delete(reqs, name)
+			if lastReq == name {
+				lastReq = ""
+			}
+		}
+	}
+}
+
+// forgetResponse removes a response once its body is closed, unless it is the
+// last one received
+func forgetResponse(name string) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
+	if name == lastResp {
+		lastRespClosed = true
+		return
+	}
+	delete(resps, name)
+}
+
+// responseArg resolves the response named by the i-th argument, falling back
+// to the last received response
+func responseArg(args []*lang.Object, i int) (*http.Response, error) {
+	httpLock.Lock()
+	defer httpLock.Unlock()
 	respName := lastResp
-	if len(args) > 1 {
-		if args[0].Type == lang.ObjStr {
-			respName = args[0].StrV
-		} else {
-			return lang.NewNil(), badType.Get("response name must be a string")
+	if len(args) > i {
+		if args[i].Type != lang.ObjStr {
+			return nil, badType.Get("response name must be a string")
 		}
+		respName = args[i].StrV
 	} else if respName == "" {
-		return lang.NewNil(), badState.Get("could not infer response name")
+		return nil, badState.Get("could not infer response name")
 	}
 	resp, ok := resps[respName]
 	if !ok {
-		return lang.NewNil(), badState.Get("no response named `" + respName + "` exists")
+		return nil, badState.Get("no response named `" + respName + "` exists")
+	}
+	return resp, nil
+}
+
+// quickRequest sends a request without any extra options
+func quickRequest(method string, args []*lang.Object, hasBody bool) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need URL")
+	}
+	in := args[0]
+	if in.Type != lang.ObjStr {
+		return nil, badType.Get("URL must be a string")
+	}
+	req := newRequest(method, in.StrV)
+	if hasBody && len(args) >= 2 {
+		req.body = strings.NewReader(args[1].String())
+	}
+	return req.send()
+}
+
+func fHttpGet(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("GET", args, false)
+}
+
+func fHttpHead(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("HEAD", args, false)
+}
+
+func fHttpDelete(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("DELETE", args, false)
+}
+
+func fHttpPost(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("POST", args, true)
+}
+
+func fHttpPut(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("PUT", args, true)
+}
+
+func fHttpPatch(args []*lang.Object) (*lang.Object, error) {
+	return quickRequest("PATCH", args, true)
+}
+
+func fHttpRequest(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need method and URL")
+	}
+	if args[0].Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("method must be a string")
+	}
+	if args[1].Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("URL must be a string")
+	}
+	httpLock.Lock()
+	defer httpLock.Unlock()
+	reqName := fmt.Sprintf("request%d", reqCount)
+	reqCount++
+	reqs[reqName] = newRequest(args[0].StrV, args[1].StrV)
+	lastReq = reqName
+	return lang.NewStr(reqName), nil
+}
+
+func fHttpHeader(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need header name and value")
+	}
+	req, err := requestArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req.header.Set(args[0].String(), args[1].String())
+	return lang.NewNil(), nil
+}
+
+func fHttpQuery(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need parameter name and value")
+	}
+	req, err := requestArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req.query.Add(args[0].String(), args[1].String())
+	return lang.NewNil(), nil
+}
+
+func fHttpAuthBasic(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need user name and password")
+	}
+	req, err := requestArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	auth := args[0].String() + ":" + args[1].String()
+	req.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	return lang.NewNil(), nil
+}
+
+func fHttpAuthBearer(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need token")
+	}
+	req, err := requestArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req.header.Set("Authorization", "Bearer "+args[0].String())
+	return lang.NewNil(), nil
+}
+
+func fHttpBody(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need body")
+	}
+	req, err := requestArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req.body = strings.NewReader(args[0].String())
+	return lang.NewNil(), nil
+}
+
+func fHttpBodyStream(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need stream name")
+	}
+	if args[0].Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("stream name must be a string")
+	}
+	stream, ok := getStream(args[0].StrV)
+	if !ok {
+		return lang.NewNil(), badState.Get("no stream named " + args[0].StrV + " is open")
+	}
+	req, err := requestArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	// the stream is left open, it's up to the script to close it
+	req.body = stream
+	return lang.NewNil(), nil
+}
+
+func fHttpTimeout(args []*lang.Object) (*lang.Object, error) {
+	ms, err := intArg(args, 0, "timeout in milliseconds")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req, err := requestArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req.timeout = time.Duration(ms) * time.Millisecond
+	return lang.NewNil(), nil
+}
+
+func fHttpRedirects(args []*lang.Object) (*lang.Object, error) {
+	n, err := intArg(args, 0, "redirect limit")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	req, err := requestArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	// a limit of 0 means redirects are not followed at all
+	req.redirects = n
+	return lang.NewNil(), nil
+}
+
+func fHttpSend(args []*lang.Object) (*lang.Object, error) {
+	req, err := requestArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	forgetRequest(req)
+	return req.send()
+}
+
+func fHttpOk(args []*lang.Object) (*lang.Object, error) {
+	resp, err := responseArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
 	}
 	return lang.NewBool(resp.StatusCode >= 200 && resp.StatusCode < 300), nil
 }
+
+func fHttpStatus(args []*lang.Object) (*lang.Object, error) {
+	resp, err := responseArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewInt(resp.StatusCode), nil
+}
+
+func fHttpStatusText(args []*lang.Object) (*lang.Object, error) {
+	resp, err := responseArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	txt := strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
+	return lang.NewStr(txt), nil
+}
+
+func fHttpResponseHeader(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need header name")
+	}
+	resp, err := responseArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	v, ok := resp.Header[http.CanonicalHeaderKey(args[0].String())]
+	if !ok {
+		return lang.NewNil(), nil
+	}
+	return lang.NewStr(strings.Join(v, ", ")), nil
+}
+
+func fHttpResponseHeaders(args []*lang.Object) (*lang.Object, error) {
+	resp, err := responseArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	headers := make(map[string]string, len(resp.Header))
+	for k, v := range resp.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+	return lang.NewObject(headers), nil
+}
+
+func fHttpCookies(args []*lang.Object) (*lang.Object, error) {
+	resp, err := responseArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	cookies := make(map[string]string)
+	for _, c := range resp.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	return lang.NewObject(cookies), nil
+}
+
+// ResponseStream streams the body of an HTTP response as it is being received.
+// It can only be read from and seeked forward.
+type ResponseStream struct {
+	name string
+	body io.ReadCloser
+	pos  int64
+}
+
+func (s *ResponseStream) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *ResponseStream) Write(p []byte) (int, error) {
+	return 0, badState.Get("cannot write to an HTTP response")
+}
+
+func (s *ResponseStream) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = s.pos + offset
+	default:
+		return s.pos, badState.Get("can only seek from the start or current position of an HTTP response")
+	}
+	if target < s.pos {
+		return s.pos, badState.Get("cannot seek backwards in an HTTP response")
+	}
+	// skip over the data in between
+	n, err := io.CopyN(io.Discard, s.body, target-s.pos)
+	s.pos += n
+	if err == io.EOF {
+		err = nil
+	}
+	return s.pos, err
+}
+
+func (s *ResponseStream) Close() error {
+	forgetResponse(s.name)
+	return s.body.Close()
+}
@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mohazit/lang"
+	"strconv"
+	"strings"
+)
+
+// fromJSON converts a value decoded by encoding/json into an object
+func fromJSON(v interface{}) *lang.Object {
+	switch v := v.(type) {
+	case nil:
+		return lang.NewNil()
+	case bool:
+		return lang.NewBool(v)
+	case string:
+		return lang.NewStr(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil && i >= math.MinInt && i <= math.MaxInt {
+			return lang.NewInt(int(i))
+		}
+		f, _ := v.Float64()
+		return lang.NewFloat(f)
+	case []interface{}:
+		items := make([]*lang.Object, len(v))
+		for i, item := range v {
+			items[i] = fromJSON(item)
+		}
+		return lang.NewList(items)
+	case map[string]interface{}:
+		items := make(map[string]*lang.Object, len(v))
+		for k, item := range v {
+			items[k] = fromJSON(item)
+		}
+		return lang.NewMap(items)
+	}
+	return lang.NewStr(fmt.Sprint(v))
+}
+
+// decodeJSON reads a single JSON value from the given reader, which may hold
+// nothing but whitespace after the value
+func decodeJSON(r io.Reader) (*lang.Object, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return lang.NewNil(), badArg.Get("invalid JSON: " + err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return lang.NewNil(), badArg.Get("invalid JSON: unexpected data after the value")
+	}
+	return fromJSON(v), nil
+}
+
+// byteReader hands out one byte per read, so that a decoder reading from it
+// never reads more than a byte past the end of a value
+type byteReader struct {
+	r *bufio.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := b.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = c
+	return 1, nil
+}
+
+// readJSON reads a single JSON value from the reader of a stream, leaving
+// whatever comes after the value to be read next
+func readJSON(r *bufio.Reader) (*lang.Object, error) {
+	dec := json.NewDecoder(byteReader{r})
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	// strings, numbers and literals only end once the next byte is seen
+	if n, _ := io.Copy(io.Discard, dec.Buffered()); n > 0 {
+		r.UnreadByte()
+	}
+	if err != nil {
+		return lang.NewNil(), badArg.Get("invalid JSON: " + err.Error())
+	}
+	return fromJSON(v), nil
+}
+
+// encodeJSON turns the object into JSON text, optionally indented
+func encodeJSON(o *lang.Object, pretty bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(goValue(o)); err != nil {
+		return nil, badArg.Get("cannot encode JSON: " + err.Error())
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func fJsonParse(args []*lang.Object) (*lang.Object, error) {
+	text, err := strArg(args, 0, "JSON text")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return decodeJSON(strings.NewReader(text))
+}
+
+func fJsonStringify(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	pretty := len(args) >= 2 && args[1].Type == lang.ObjBool && args[1].BoolV
+	data, err := encodeJSON(args[0], pretty)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(string(data)), nil
+}
+
+func fJsonRead(args []*lang.Object) (*lang.Object, error) {
+	streamName, r, err := readerArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("decoding JSON", lang.F("stream", streamName))
+
+	// streams may hold more values after this one
+	return readJSON(r)
+}
+
+func fJsonWrite(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need input")
+	}
+	streamName, stream, err := streamArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	data, err := encodeJSON(args[0], false)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("writing JSON", lang.F("stream", streamName), lang.F("bytes", len(data)))
+
+	n, err := stream.Write(data)
+	return lang.NewInt(n), err
+}
+
+func fJsonPath(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need object and path")
+	}
+	cur := args[0]
+	path := strings.Trim(args[1].String(), ".")
+	if path == "" {
+		return cur, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch cur.Type {
+		case lang.ObjMap:
+			v, ok := cur.MapV[key]
+			if !ok {
+				return lang.NewNil(), nil
+			}
+			cur = v
+		case lang.ObjList:
+			idx, err := strconv.Atoi(key)
+			if err != nil {
+				return lang.NewNil(), badArg.Get("list index must be an integer: " + key)
+			}
+			if idx < 0 {
+				idx += len(cur.ListV)
+			}
+			if idx < 0 || idx >= len(cur.ListV) {
+				return lang.NewNil(), nil
+			}
+			cur = cur.ListV[idx]
+		default:
+			return lang.NewNil(), nil
+		}
+	}
+	return cur, nil
+}
@@ -1,55 +1,305 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"mohazit/lang"
+	"net/http"
+	"regexp"
 	"strings"
 )
 
 func Load() {
+	streamsLock.Lock()
 	streams["void"] = &DummyStream{}
+	streamsLock.Unlock()
+	patterns = make(map[string]*regexp.Regexp)
+	routes = []*route{}
+	servers = make(map[string]*httpServer)
+	lastServer = ""
+	reqs = make(map[string]*httpRequest)
+	lastReq = ""
+	resps = make(map[string]*http.Response)
+	lastResp = ""
+	lastRespClosed = false
+	tasks = make(map[string]*task)
+	chans = make(map[string]*channel)
+	locks = make(map[string]chan struct{})
+	cmds = make(map[string]*command)
+	procs = make(map[string]*process)
+	archives = make(map[string]archive)
+	dirStack = []string{}
+	watchers = make(map[string]*watcher)
+	lastWatcher = ""
+	started = lang.Time.Now()
+	lang.StreamWriter = func(name string) (io.Writer, bool) {
+		return getStream(name)
+	}
 	lang.Funcs = lang.VFuncMap{
 		// user interaction
-		"say":     fSay,
-		"type-of": fTypeOf,
+		"ask":        fAsk,
+		"ask-number": fAskNumber,
+		"ask-secret": fAskSecret,
+		"confirm":    fConfirm,
+		"choose":     fChoose,
+		"log-level":  fLogLevel,
+		// strings
+		"str-len":         fStrLen,
+		"str-upper":       fStrUpper,
+		"str-lower":       fStrLower,
+		"str-title":       fStrTitle,
+		"str-trim":        fStrTrim,
+		"str-trim-left":   fStrTrimLeft,
+		"str-trim-right":  fStrTrimRight,
+		"str-trim-prefix": fStrTrimPrefix,
+		"str-trim-suffix": fStrTrimSuffix,
+		"str-contains":    fStrContains,
+		"str-starts-with": fStrStartsWith,
+		"str-ends-with":   fStrEndsWith,
+		"str-index-of":    fStrIndexOf,
+		"str-sub":         fStrSub,
+		"substring":       fStrSub,
+		"str-replace":     fStrReplace,
+		"str-replace-all": fStrReplaceAll,
+		"str-split":       fStrSplit,
+		"str-join":        fStrJoin,
+		"str-repeat":      fStrRepeat,
+		"str-pad-left":    fStrPadLeft,
+		"str-pad-right":   fStrPadRight,
+		"str-reverse":     fStrReverse,
+		"format":          fFormat,
+		// regular expressions
+		"re-match":    fReMatch,
+		"re-find":     fReFind,
+		"re-find-all": fReFindAll,
+		"re-replace":  fReReplace,
+		"re-split":    fReSplit,
+		// json
+		"json-parse":     fJsonParse,
+		"json-stringify": fJsonStringify,
+		"json-read":      fJsonRead,
+		"json-write":     fJsonWrite,
+		"json-path":      fJsonPath,
+		// lists
+		"list":        fList,
+		"list-get":    fListGet,
+		"list-len":    fListLen,
+		"list-append": fListAppend,
+		// maps
+		"map":      fMap,
+		"map-get":  fMapGet,
+		"map-set":  fMapSet,
+		"map-has":  fMapHas,
+		"map-keys": fMapKeys,
+		// environment
+		"env-get":   fEnvGet,
+		"env-set":   fEnvSet,
+		"env-unset": fEnvUnset,
+		"env-list":  fEnvList,
 		// numeric
 		"random":         fRandom,
+		"rng":            fRandom,
 		"limited-random": fLimitedRandom,
+		"limited-rng":    fLimitedRandom,
 		"randi":          fLimitedRandom,
+		"lrng":           fLimitedRandom,
+		"random-range":   fRandomRange,
+		"random-float":   fRandomFloat,
+		"random-seed":    fRandomSeed,
+		"random-choice":  fRandomChoice,
+		"shuffle":        fShuffle,
+		"crypto-random":  fCryptoRandom,
+		"crypto-bytes":   fCryptoBytes,
+		"crypto-token":   fCryptoToken,
+		"uuid":           fUuid,
 		"atoi":           fAtoi,
 		"stringify":      fStringify,
 		"inc":            fInc,
 		"dec":            fDec,
 		"neg":            fNeg,
 		// file management
-		"file-open":   fFileOpen,
-		"file-create": fFileCreate,
-		"file-delete": fFileDelete,
-		"file-rename": fFileRename,
-		"file-list":   fFileList,
-		"file-exists": fFileExists,
-		"dir":         fFileList,
-		"ls":          fFileList,
-		"walk":        fWalk,
-		"cd":          fWalk,
+		"file-open":         fFileOpen,
+		"file-create":       fFileCreate,
+		"file-delete":       fFileDelete,
+		"file-rename":       fFileRename,
+		"file-exists":       fFileExists,
+		"file-read":         fFileRead,
+		"file-read-bytes":   fFileReadBytes,
+		"file-lines":        fFileLines,
+		"file-write":        fFileWrite,
+		"file-append":       fFileAppend,
+		"file-write-atomic": fFileWriteAtomic,
+		"walk":              fWalk,
+		"cd":                fWalk,
+		"pushd":             fPushd,
+		"popd":              fPopd,
+		"dir-create":        fDirCreate,
+		"mkdir":             fDirCreate,
+		"dir-remove":        fDirRemove,
+		"file-copy":         fFileCopy,
+		"cp":                fFileCopy,
+		"file-move":         fFileMove,
+		"mv":                fFileMove,
+		"file-stat":         fFileStat,
+		"file-chmod":        fFileChmod,
+		"chmod":             fFileChmod,
+		"file-symlink":      fFileSymlink,
+		"file-glob":         fFileGlob,
+		"glob":              fFileGlob,
+		// paths
+		"path-join":  fPathJoin,
+		"path-base":  fPathBase,
+		"path-dir":   fPathDir,
+		"path-ext":   fPathExt,
+		"path-abs":   fPathAbs,
+		"path-rel":   fPathRel,
+		"path-clean": fPathClean,
+		"path-split": fPathSplit,
+		"home-dir":   fHomeDir,
+		"temp-dir":   fTempDir,
 		// external processes
-		"run":   fRun,
-		"start": fRun,
+		"run":              fRun,
+		"start":            fStart,
+		"!":                fBang,
+		"cmd":              fCmd,
+		"cmd-stdin":        fCmdStdin,
+		"cmd-stdin-stream": fCmdStdinStream,
+		"cmd-env":          fCmdEnv,
+		"cmd-dir":          fCmdDir,
+		"cmd-timeout":      fCmdTimeout,
+		"cmd-run":          fCmdRun,
+		"cmd-start":        fCmdStart,
+		"proc-wait":        fProcWait,
+		"proc-kill":        fProcKill,
+		"proc-signal":      fProcSignal,
+		"proc-running":     fProcRunning,
+		"pipe":             fPipe,
+		// binary data
+		"bytes":         fBytes,
+		"bytes-str":     fBytesStr,
+		"bytes-len":     fBytesLen,
+		"pack":          fPack,
+		"unpack":        fUnpack,
+		"pack-size":     fPackSize,
+		"hex-encode":    fHexEncode,
+		"hex-decode":    fHexDecode,
+		"base64-encode": fBase64Encode,
+		"base64-decode": fBase64Decode,
 		// data streams
-		"buf-create": fBufCreate,
-		"data-read":  fDataRead,
-		"data-write": fDataWrite,
-		"data-seek":  fDataSeek,
-		"data-close": fDataClose,
-		"data-copy":  fDataCopy,
+		"buf-create":            fBufCreate,
+		"data-read":             fDataRead,
+		"data-read-line":        fDataReadLine,
+		"data-read-until":       fDataReadUntil,
+		"data-read-all":         fDataReadAll,
+		"data-read-exact":       fDataReadExact,
+		"data-eof?":             fDataEOF,
+		"data-read-bytes":       fDataReadBytes,
+		"data-read-exact-bytes": fDataReadExactBytes,
+		"data-write":            fDataWrite,
+		"data-seek":             fDataSeek,
+		"data-close":            fDataClose,
+		"data-copy":             fDataCopy,
+		"stream-gzip":           fStreamGzip,
+		"stream-gunzip":         fStreamGunzip,
+		"stream-zlib":           fStreamZlib,
+		"stream-unzlib":         fStreamUnzlib,
+		"stream-base64":         fStreamBase64,
+		"stream-unbase64":       fStreamUnbase64,
+		"stream-hash":           fStreamHash,
+		"stream-hash-sum":       fStreamHashSum,
+		// archives
+		"zip-create":     fZipCreate,
+		"zip-add":        fArchiveAdd,
+		"zip-close":      fArchiveClose,
+		"zip-list":       fZipList,
+		"zip-extract":    fZipExtract,
+		"zip-open-entry": fZipOpenEntry,
+		"tar-create":     fTarCreate,
+		"tar-add":        fArchiveAdd,
+		"tar-close":      fArchiveClose,
+		"tar-list":       fTarList,
+		"tar-extract":    fTarExtract,
+		"tar-open-entry": fTarOpenEntry,
 		// http
-		"http-get": fHttpGet,
-		"http-ok":  fHttpOk,
+		"http-get":              fHttpGet,
+		"http-head":             fHttpHead,
+		"http-delete":           fHttpDelete,
+		"http-post":             fHttpPost,
+		"http-put":              fHttpPut,
+		"http-patch":            fHttpPatch,
+		"http-request":          fHttpRequest,
+		"http-header":           fHttpHeader,
+		"http-query":            fHttpQuery,
+		"http-auth-basic":       fHttpAuthBasic,
+		"http-auth-bearer":      fHttpAuthBearer,
+		"http-body":             fHttpBody,
+		"http-body-stream":      fHttpBodyStream,
+		"http-timeout":          fHttpTimeout,
+		"http-redirects":        fHttpRedirects,
+		"http-send":             fHttpSend,
+		"http-ok":               fHttpOk,
+		"http-status":           fHttpStatus,
+		"http-status-text":      fHttpStatusText,
+		"http-response-header":  fHttpResponseHeader,
+		"http-response-headers": fHttpResponseHeaders,
+		"http-cookies":          fHttpCookies,
+		// http server
+		"route":               fRoute,
+		"http-static":         fHttpStatic,
+		"http-listen":         fHttpListen,
+		"http-stop":           fHttpStop,
+		"http-respond":        fHttpRespond,
+		"http-respond-status": fHttpRespondStatus,
+		"http-respond-header": fHttpRespondHeader,
+		// concurrency
+		"wait":       fWait,
+		"join":       fWait,
+		"chan-make":  fChanMake,
+		"chan-send":  fChanSend,
+		"chan-recv":  fChanRecv,
+		"chan-close": fChanClose,
+		"select":     fSelect,
+		"lock":       fLock,
+		"unlock":     fUnlock,
+		// time
+		"now":           fNow,
+		"unix-time":     fUnixTime,
+		"from-unix":     fFromUnix,
+		"time-format":   fTimeFormat,
+		"time-parse":    fTimeParse,
+		"time-fields":   fTimeFields,
+		"time-add":      fTimeAdd,
+		"time-add-date": fTimeAddDate,
+		"time-sub":      fTimeSub,
+		"time-before":   fTimeBefore,
+		"duration":      fDuration,
+		"duration-ms":   fDurationMs,
+		"sleep":         fSleep,
+		"since":         fSince,
+		"elapsed":       fElapsed,
+		// watching files
+		"watch":          fWatch,
+		"watch-stop":     fWatchStop,
+		"watch-interval": fWatchInterval,
+		"watch-debounce": fWatchDebounce,
 		// socket
 		"sock-dial":   fSockDial,
 		"sock-listen": fSockListen,
 		"sock-accept": fSockAccept,
 	}
+	// built-ins that write output are given where to write it
+	lang.OutFuncs = lang.VOutFuncMap{
+		"say":        fSay,
+		"type-of":    fTypeOf,
+		"file-list":  fFileList,
+		"dir":        fFileList,
+		"ls":         fFileList,
+		"spawn":      fSpawn,
+		"http-wait":  fHttpWait,
+		"http-serve": fHttpServe,
+		"watch-wait": fWatchWait,
+	}
 	lang.Comps = lang.VCompMap{
 		"=":  cEquals,
 		"==": cEquals,
@@ -58,24 +308,87 @@ func Load() {
 		"<>": cNotEquals,
 		">":  cGreater,
 		"<":  cLesser,
+		// named comparators are written as `[name]`
+		"matches": cMatches,
 	}
 	lang.OperChars = []byte{}
 	for op := range lang.Comps {
 		for _, c := range op {
+			if (c >= 'a' && c <= 'z') || c == '-' {
+				continue
+			}
 			lang.OperChars = append(lang.OperChars, byte(c))
 		}
 	}
 }
 
+// cleanupErrors are all the problems found while cleaning up
+type cleanupErrors []error
+
+func (e cleanupErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is and As look through all the errors, like errors.Is and errors.As do for
+// a single wrapped one
+func (e cleanupErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e cleanupErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cleanup stops everything the script left running. Every step is taken even
+// if an earlier one fails, and all the problems are reported together.
 func Cleanup() error {
+	// tasks still running are stopped by the limits of the run
+	defer lang.Finish()
+	var errs cleanupErrors
+	if err := stopServers(); err != nil {
+		errs = append(errs, err)
+	}
+	stopWatchers()
+	// the script is only done once everything it spawned is
+	if err := waitTasks(); err != nil {
+		errs = append(errs, err)
+	}
+	if killed := stopProcs(); len(killed) > 0 {
+		errs = append(errs, fmt.Errorf("killed leftover processes: %s", strings.Join(killed, ", ")))
+	}
+	if unclosed := closeArchives(); len(unclosed) > 0 {
+		errs = append(errs, fmt.Errorf("unclosed archives: %s", strings.Join(unclosed, ", ")))
+	}
 	unclosedStreams := []string{}
+	streamsLock.Lock()
 	for streamName, stream := range streams {
 		if _, ok := stream.(*DummyStream); !ok {
 			unclosedStreams = append(unclosedStreams, streamName)
 		}
 	}
+	streamsLock.Unlock()
 	if len(unclosedStreams) > 0 {
-		return fmt.Errorf("unclosed streams: %s", strings.Join(unclosedStreams, ", "))
+		errs = append(errs, fmt.Errorf("unclosed streams: %s", strings.Join(unclosedStreams, ", ")))
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
 	}
-	return nil
+	return errs
 }
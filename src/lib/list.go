@@ -0,0 +1,56 @@
+package lib
+
+import "mohazit/lang"
+
+func fList(args []*lang.Object) (*lang.Object, error) {
+	items := make([]*lang.Object, len(args))
+	copy(items, args)
+	return lang.NewList(items), nil
+}
+
+func fListGet(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need list and index")
+	}
+	listObj := args[0]
+	if listObj.Type != lang.ObjList {
+		return lang.NewNil(), badType.Get("first argument must be a list")
+	}
+	idxObj := args[1]
+	if idxObj.Type != lang.ObjInt {
+		return lang.NewNil(), badType.Get("index must be an integer")
+	}
+	idx := idxObj.IntV
+	if idx < 0 {
+		idx += len(listObj.ListV)
+	}
+	if idx < 0 || idx >= len(listObj.ListV) {
+		return lang.NewNil(), badArg.Get("index out of range")
+	}
+	return listObj.ListV[idx], nil
+}
+
+func fListLen(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need list")
+	}
+	listObj := args[0]
+	if listObj.Type != lang.ObjList {
+		return lang.NewNil(), badType.Get("argument must be a list")
+	}
+	return lang.NewInt(len(listObj.ListV)), nil
+}
+
+func fListAppend(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need list")
+	}
+	listObj := args[0]
+	if listObj.Type != lang.ObjList {
+		return lang.NewNil(), badType.Get("first argument must be a list")
+	}
+	items := make([]*lang.Object, 0, len(listObj.ListV)+len(args)-1)
+	items = append(items, listObj.ListV...)
+	items = append(items, args[1:]...)
+	return lang.NewList(items), nil
+}
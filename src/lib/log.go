@@ -0,0 +1,15 @@
+package lib
+
+import "mohazit/lang"
+
+func fLogLevel(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewStr(lang.Log.Level().String()), nil
+	}
+	level, ok := lang.ParseLevel(args[0].String())
+	if !ok {
+		return lang.NewNil(), badArg.Get("unknown log level " + args[0].String())
+	}
+	lang.Log.SetLevel(level)
+	return lang.NewStr(level.String()), nil
+}
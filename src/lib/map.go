@@ -0,0 +1,71 @@
+package lib
+
+import "mohazit/lang"
+
+func fMap(args []*lang.Object) (*lang.Object, error) {
+	if len(args)%2 != 0 {
+		return lang.NewNil(), badArg.Get("need a value for every key")
+	}
+	items := make(map[string]*lang.Object, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		items[args[i].String()] = args[i+1]
+	}
+	return lang.NewMap(items), nil
+}
+
+func fMapGet(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need map and key")
+	}
+	mapObj := args[0]
+	if mapObj.Type != lang.ObjMap {
+		return lang.NewNil(), badType.Get("first argument must be a map")
+	}
+	v, ok := mapObj.MapV[args[1].String()]
+	if !ok {
+		if len(args) >= 3 {
+			return args[2], nil
+		}
+		return lang.NewNil(), nil
+	}
+	return v, nil
+}
+
+func fMapSet(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 3 {
+		return lang.NewNil(), moreArgs.Get("need map, key and value")
+	}
+	mapObj := args[0]
+	if mapObj.Type != lang.ObjMap {
+		return lang.NewNil(), badType.Get("first argument must be a map")
+	}
+	items := make(map[string]*lang.Object, len(mapObj.MapV)+1)
+	for k, v := range mapObj.MapV {
+		items[k] = v
+	}
+	items[args[1].String()] = args[2]
+	return lang.NewMap(items), nil
+}
+
+func fMapHas(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need map and key")
+	}
+	mapObj := args[0]
+	if mapObj.Type != lang.ObjMap {
+		return lang.NewNil(), badType.Get("first argument must be a map")
+	}
+	_, ok := mapObj.MapV[args[1].String()]
+	return lang.NewBool(ok), nil
+}
+
+func fMapKeys(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need map")
+	}
+	mapObj := args[0]
+	if mapObj.Type != lang.ObjMap {
+		return lang.NewNil(), badType.Get("argument must be a map")
+	}
+	return lang.NewObject(mapObj.Keys()), nil
+}
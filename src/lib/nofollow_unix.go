@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package lib
+
+import "syscall"
+
+// oNoFollow makes opening a file fail if it is a symlink
+const oNoFollow = syscall.O_NOFOLLOW
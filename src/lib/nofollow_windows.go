@@ -0,0 +1,5 @@
+package lib
+
+// oNoFollow is not available on windows, where extracted files are only kept
+// inside of the destination by checking where their directory really is
+const oNoFollow = 0
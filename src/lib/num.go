@@ -1,35 +1,10 @@
 package lib
 
 import (
-	"math/rand"
 	"mohazit/lang"
 	"strconv"
-	"time"
 )
 
-var random = rand.New(rand.NewSource(time.Now().Unix()))
-
-func fRandom(args []*lang.Object) (*lang.Object, error) {
-	return &lang.Object{
-		Type: lang.ObjInt,
-		IntV: random.Int(),
-	}, nil
-}
-
-func fLimitedRandom(args []*lang.Object) (*lang.Object, error) {
-	if len(args) < 1 {
-		return lang.NewNil(), moreArgs.Get("need bound")
-	}
-	in := args[0]
-	if in.Type != lang.ObjInt {
-		return nil, badType.Get("bound must be an integer")
-	}
-	return &lang.Object{
-		Type: lang.ObjInt,
-		IntV: random.Intn(in.IntV),
-	}, nil
-}
-
 func fAtoi(args []*lang.Object) (*lang.Object, error) {
 	if len(args) < 1 {
 		return lang.NewNil(), moreArgs.Get("need input")
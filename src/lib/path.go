@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"mohazit/lang"
+	"os"
+	"path/filepath"
+)
+
+// pathArgs returns all arguments as path segments
+func pathArgs(args []*lang.Object) ([]string, error) {
+	if len(args) < 1 {
+		return nil, moreArgs.Get("need path")
+	}
+	segments := make([]string, len(args))
+	for i, o := range args {
+		segments[i] = o.String()
+	}
+	return segments, nil
+}
+
+func fPathJoin(args []*lang.Object) (*lang.Object, error) {
+	segments, err := pathArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(filepath.Join(segments...)), nil
+}
+
+func fPathBase(args []*lang.Object) (*lang.Object, error) {
+	p, err := strArg(args, 0, "path")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(filepath.Base(p)), nil
+}
+
+func fPathDir(args []*lang.Object) (*lang.Object, error) {
+	p, err := strArg(args, 0, "path")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(filepath.Dir(p)), nil
+}
+
+// fPathExt returns the extension of the path, including the dot
+func fPathExt(args []*lang.Object) (*lang.Object, error) {
+	p, err := strArg(args, 0, "path")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(filepath.Ext(p)), nil
+}
+
+func fPathAbs(args []*lang.Object) (*lang.Object, error) {
+	segments, err := pathArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	abs, err := filepath.Abs(filepath.Join(segments...))
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(abs), nil
+}
+
+// fPathRel returns the second path relative to the first one
+func fPathRel(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need base and target paths")
+	}
+	rel, err := filepath.Rel(args[0].String(), args[1].String())
+	if err != nil {
+		return lang.NewNil(), badArg.Get(err.Error())
+	}
+	return lang.NewStr(rel), nil
+}
+
+func fPathClean(args []*lang.Object) (*lang.Object, error) {
+	p, err := strArg(args, 0, "path")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(filepath.Clean(p)), nil
+}
+
+// fPathSplit splits the path into its directory, with a trailing separator,
+// and its last element
+func fPathSplit(args []*lang.Object) (*lang.Object, error) {
+	p, err := strArg(args, 0, "path")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	dir, file := filepath.Split(p)
+	return lang.NewObject([]string{dir, file}), nil
+}
+
+func fHomeDir(args []*lang.Object) (*lang.Object, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(home), nil
+}
+
+func fTempDir(args []*lang.Object) (*lang.Object, error) {
+	return lang.NewStr(os.TempDir()), nil
+}
@@ -1,103 +1,730 @@
 package lib
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mohazit/lang"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func fRun(args []*lang.Object) (*lang.Object, error) {
-	var cmd string
-	// var annotations []string
-	if len(args) < 1 {
-		return lang.NewNil(), moreArgs.Get("need command")
-	}
-	cmdObj := args[0]
-	if cmdObj.Type != lang.ObjStr {
-		return lang.NewNil(), badType.Get("command must be a string")
-	}
-	cmd = cmdObj.StrV + " "
-	// if len(args) >= 2 {
-	// 	annotObj := args[1]
-	// 	if annotObj.Type != lang.ObjStr {
-	// 		return lang.NewNil(), badType.Get("annotations must be a string")
-	// 	}
-	// 	annotations = strings.Split(annotObj.StrV, " ")
-	// }
-
-	fmt.Printf("command: %s\n", cmd)
-
-	cmdProgramName := ""
-	cmdArgs := []string{}
-	hasProg := false
-	ctx := ""
-	for _, c := range cmd {
-		if c == ' ' {
-			if !hasProg {
-				cmdProgramName = strings.TrimSpace(ctx)
-				cmdArgs = append(cmdArgs, cmdProgramName)
-				ctx = ""
-				hasProg = true
+// command is a process that is being set up before it is run
+type command struct {
+	args    []string
+	stdin   io.Reader
+	env     []string
+	dir     string
+	timeout time.Duration
+}
+
+var cmds = make(map[string]*command)
+var cmdCount = 0
+var lastCmd = ""
+var cmdsLock sync.Mutex
+
+// splitCommand splits a command line into arguments the way a shell would:
+// on whitespace, except inside of single or double quotes or after a
+// backslash. Nothing else, like variables or globbing, is expanded.
+func splitCommand(line string) ([]string, error) {
+	args := []string{}
+	cur := strings.Builder{}
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
 			} else {
-				cmdArgs = append(cmdArgs, strings.TrimSpace(ctx))
-				ctx = ""
+				cur.WriteRune(c)
 			}
-			continue
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
 		}
-		ctx += string(c)
 	}
-	if len(ctx) > 0 {
-		cmdArgs = append(cmdArgs, strings.TrimSpace(ctx))
+	if quote != 0 {
+		return nil, badArg.Get("unterminated quote in command")
+	}
+	if escaped {
+		return nil, badArg.Get("command ends with a backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// commandArgs reads the program and its arguments. A single string is split
+// like a shell would, while a list or several arguments are used as they are.
+func commandArgs(args []*lang.Object) ([]string, error) {
+	if len(args) < 1 {
+		return nil, moreArgs.Get("need command")
+	}
+	var out []string
+	switch {
+	case args[0].Type == lang.ObjList:
+		for _, o := range args[0].ListV {
+			out = append(out, o.String())
+		}
+	case len(args) == 1:
+		var err error
+		if out, err = splitCommand(args[0].String()); err != nil {
+			return nil, err
+		}
+	default:
+		for _, o := range args {
+			out = append(out, o.String())
+		}
+	}
+	if len(out) == 0 || out[0] == "" {
+		return nil, badArg.Get("command is empty")
+	}
+	return out, nil
+}
+
+// prepare resolves the program and sets up the process, along with the
+// context it runs in and a function releasing that context
+func (c *command) prepare() (*exec.Cmd, context.Context, context.CancelFunc, error) {
+	program, err := exec.LookPath(c.args[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := allowExec(c.args[0], program); err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := lang.Context(), context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+	// the process is killed if the script is cancelled or it times out
+	cmd := exec.CommandContext(ctx, program)
+	cmd.Args = c.args
+	cmd.Dir = c.dir
+	cmd.Stdin = c.stdin
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	return cmd, ctx, cancel, nil
+}
+
+// run runs the command to completion. Exiting with a non-zero status is not
+// an error, it is reported in the result.
+func (c *command) run() (*lang.Object, error) {
+	lang.Log.Info("running command", lang.F("command", strings.Join(c.args, " ")))
+
+	cmd, ctx, cancel, err := c.prepare()
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	defer cancel()
+	stdout := &lang.Buffer{}
+	stderr := &lang.Buffer{}
+	defer stdout.Release()
+	defer stderr.Release()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	code := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return lang.NewNil(), err
+		}
+		if lang.Context().Err() != nil {
+			return lang.NewNil(), lang.Context().Err()
+		}
+		code = exitErr.ExitCode()
+	}
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	return lang.NewMap(map[string]*lang.Object{
+		"stdout":    lang.NewStr(stdout.String()),
+		"stderr":    lang.NewStr(stderr.String()),
+		"code":      lang.NewInt(code),
+		"ok":        lang.NewBool(code == 0),
+		"timed-out": lang.NewBool(timedOut),
+	}), nil
+}
+
+// commandArg resolves the command named by the i-th argument, falling back to
+// the last created command
+func commandArg(args []*lang.Object, i int) (*command, error) {
+	cmdsLock.Lock()
+	defer cmdsLock.Unlock()
+	cmdName := lastCmd
+	if len(args) > i {
+		if args[i].Type != lang.ObjStr {
+			return nil, badType.Get("command name must be a string")
+		}
+		cmdName = args[i].StrV
+	} else if cmdName == "" {
+		return nil, badState.Get("could not infer command name")
+	}
+	c, ok := cmds[cmdName]
+	if !ok {
+		return nil, badState.Get("no command named `" + cmdName + "` exists")
+	}
+	lastCmd = cmdName
+	return c, nil
+}
+
+func fRun(args []*lang.Object) (*lang.Object, error) {
+	cmdArgs, err := commandArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return (&command{args: cmdArgs}).run()
+}
+
+// fBang runs a command and returns only its output, without the trailing
+// newline
+func fBang(args []*lang.Object) (*lang.Object, error) {
+	res, err := fRun(args)
+	if err != nil {
+		return res, err
+	}
+	return lang.NewStr(strings.TrimSuffix(res.MapV["stdout"].StrV, "\n")), nil
+}
+
+func fCmd(args []*lang.Object) (*lang.Object, error) {
+	cmdArgs, err := commandArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	cmdsLock.Lock()
+	defer cmdsLock.Unlock()
+	cmdName := fmt.Sprintf("command%d", cmdCount)
+	cmdCount++
+	cmds[cmdName] = &command{args: cmdArgs}
+	lastCmd = cmdName
+	return lang.NewStr(cmdName), nil
+}
+
+func fCmdStdin(args []*lang.Object) (*lang.Object, error) {
+	input, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c, err := commandArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c.stdin = strings.NewReader(input)
+	return lang.NewNil(), nil
+}
+
+func fCmdStdinStream(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need stream name")
+	}
+	_, stream, err := streamArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c, err := commandArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	// the stream is left open, it's up to the script to close it
+	c.stdin = stream
+	return lang.NewNil(), nil
+}
+
+func fCmdEnv(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need variable name and value")
+	}
+	c, err := commandArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c.env = append(c.env, args[0].String()+"="+args[1].String())
+	return lang.NewNil(), nil
+}
+
+func fCmdDir(args []*lang.Object) (*lang.Object, error) {
+	dir, err := strArg(args, 0, "directory")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if err := allowRead(dir); err != nil {
+		return lang.NewNil(), err
+	}
+	c, err := commandArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c.dir = dir
+	return lang.NewNil(), nil
+}
+
+func fCmdTimeout(args []*lang.Object) (*lang.Object, error) {
+	ms, err := intArg(args, 0, "timeout in milliseconds")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c, err := commandArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	c.timeout = time.Duration(ms) * time.Millisecond
+	return lang.NewNil(), nil
+}
+
+func fCmdRun(args []*lang.Object) (*lang.Object, error) {
+	c, err := commandArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return c.run()
+}
+
+// process is a command running in the background
+type process struct {
+	cmd  *exec.Cmd
+	ctx  context.Context
+	done chan struct{}
+	err  error
+	// streams are the names of the stdin, stdout and stderr streams that
+	// were registered for the process
+	streams []string
+}
+
+var procs = make(map[string]*process)
+var procCount = 0
+var lastProc = ""
+var procsLock sync.Mutex
+
+// lockedBuffer is a buffer that can be written to from several goroutines
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  lang.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// PipeStream is one end of a pipe to or from a process
+type PipeStream struct {
+	f *os.File
+	// stop ends the watch for the script being cancelled
+	stop func()
+}
+
+// newPipeStream wraps one end of a pipe, which is interrupted once the
+// script is cancelled
+func newPipeStream(f *os.File) *PipeStream {
+	s := &PipeStream{f: f}
+	s.stop = onCancel(s.interrupt)
+	return s
+}
+
+func (s *PipeStream) interrupt() {
+	s.f.SetDeadline(time.Now())
+}
+
+func (s *PipeStream) Read(p []byte) (int, error) {
+	return s.f.Read(p)
+}
+
+func (s *PipeStream) Write(p []byte) (int, error) {
+	return s.f.Write(p)
+}
+
+func (s *PipeStream) Seek(offset int64, whence int) (int64, error) {
+	return 0, badState.Get("cannot seek in a process pipe")
+}
+
+func (s *PipeStream) Close() error {
+	s.stop()
+	return s.f.Close()
+}
+
+// running tells if the process has not exited yet
+func (p *process) running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// result describes how the process exited
+func (p *process) result() (*lang.Object, error) {
+	code := 0
+	if p.err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(p.err, &exitErr) {
+			return lang.NewNil(), p.err
+		}
+		code = exitErr.ExitCode()
 	}
-	cmdProgram, err := exec.LookPath(cmdProgramName)
+	return lang.NewMap(map[string]*lang.Object{
+		"code":      lang.NewInt(code),
+		"ok":        lang.NewBool(code == 0),
+		"timed-out": lang.NewBool(p.ctx.Err() == context.DeadlineExceeded),
+	}), nil
+}
+
+// start launches the command in the background. Its standard streams are
+// registered as streams, unless the command already has an input.
+func (c *command) start() (*lang.Object, error) {
+	cmd, ctx, cancel, err := c.prepare()
 	if err != nil {
-		return nil, err
+		return lang.NewNil(), err
 	}
-	out := &CapturedOutput{target: os.Stderr}
-	out.Quiet()
-	execCmd := exec.Cmd{
-		Path:   cmdProgram,
-		Args:   cmdArgs,
-		Stdout: out,
-		Stderr: out,
+
+	procsLock.Lock()
+	procName := fmt.Sprintf("process%d", procCount)
+	procCount++
+	procsLock.Unlock()
+
+	// the child gets one end of each pipe, and the other one is kept as a
+	// stream; pipes are made by hand so that waiting doesn't close them
+	var childEnds []*os.File
+	handle := map[string]*lang.Object{"process": lang.NewStr(procName)}
+	p := &process{cmd: cmd, ctx: ctx, done: make(chan struct{})}
+	pipe := func(which string, toChild bool) (*os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		child, ours := w, r
+		if toChild {
+			child, ours = r, w
+		}
+		childEnds = append(childEnds, child)
+		streamName := procName + "-" + which
+		addStream(streamName, newPipeStream(ours))
+		p.streams = append(p.streams, streamName)
+		handle[which] = lang.NewStr(streamName)
+		return child, nil
 	}
-	if err = execCmd.Run(); err != nil {
-		return nil, err
+	fail := func(err error) (*lang.Object, error) {
+		cancel()
+		for _, f := range childEnds {
+			f.Close()
+		}
+		for _, name := range p.streams {
+			if s, ok := getStream(name); ok {
+				s.Close()
+			}
+			removeStream(name)
+		}
+		return lang.NewNil(), err
+	}
+	if c.stdin == nil {
+		if cmd.Stdin, err = pipe("stdin", true); err != nil {
+			return fail(err)
+		}
+	}
+	if cmd.Stderr, err = pipe("stderr", false); err != nil {
+		return fail(err)
+	}
+	// stdout is registered last, making it the last used stream
+	if cmd.Stdout, err = pipe("stdout", false); err != nil {
+		return fail(err)
+	}
+
+	lang.Log.Info("starting process", lang.F("process", procName),
+		lang.F("command", strings.Join(c.args, " ")))
+
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+	for _, f := range childEnds {
+		f.Close()
+	}
+	handle["pid"] = lang.NewInt(cmd.Process.Pid)
+
+	procsLock.Lock()
+	procs[procName] = p
+	lastProc = procName
+	procsLock.Unlock()
+
+	go func() {
+		defer close(p.done)
+		defer cancel()
+		p.err = cmd.Wait()
+		lang.Log.Info("process exited", lang.F("process", procName))
+	}()
+	return lang.NewMap(handle), nil
+}
+
+// procArg resolves the process given by the i-th argument, which is either a
+// handle returned by `start` or a process name, falling back to the last
+// started process
+func procArg(args []*lang.Object, i int) (string, *process, error) {
+	procsLock.Lock()
+	defer procsLock.Unlock()
+	procName := lastProc
+	if len(args) > i {
+		switch args[i].Type {
+		case lang.ObjMap:
+			name, ok := args[i].MapV["process"]
+			if !ok {
+				return "", nil, badArg.Get("map is not a process handle")
+			}
+			procName = name.String()
+		case lang.ObjStr:
+			procName = args[i].StrV
+		default:
+			return "", nil, badType.Get("process must be a handle or a name")
+		}
+	} else if procName == "" {
+		return "", nil, badState.Get("could not infer process name")
 	}
-	data, err := out.Data()
+	p, ok := procs[procName]
+	if !ok {
+		return "", nil, badState.Get("no process named `" + procName + "` exists")
+	}
+	lastProc = procName
+	return procName, p, nil
+}
+
+// waitProc waits for a process to exit and forgets about it
+func waitProc(name string, p *process) (*lang.Object, error) {
+	select {
+	case <-p.done:
+	case <-lang.Context().Done():
+		return lang.NewNil(), lang.Context().Err()
+	}
+	procsLock.Lock()
+	delete(procs, name)
+	procsLock.Unlock()
+	return p.result()
+}
+
+// stopProcs kills processes that are still running, closing their streams,
+// and forgets about all of them. It returns the names of the killed ones.
+func stopProcs() []string {
+	procsLock.Lock()
+	leftover := procs
+	procs = make(map[string]*process)
+	procsLock.Unlock()
+	killed := []string{}
+	for name, p := range leftover {
+		if p.running() {
+			p.cmd.Process.Kill()
+			<-p.done
+			for _, streamName := range p.streams {
+				if s, ok := getStream(streamName); ok {
+					s.Close()
+				}
+				removeStream(streamName)
+			}
+			killed = append(killed, name)
+		}
+	}
+	sort.Strings(killed)
+	return killed
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+func fStart(args []*lang.Object) (*lang.Object, error) {
+	cmdArgs, err := commandArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return (&command{args: cmdArgs}).start()
+}
+
+func fCmdStart(args []*lang.Object) (*lang.Object, error) {
+	c, err := commandArg(args, 0)
 	if err != nil {
-		return nil, err
+		return lang.NewNil(), err
 	}
-	res := strings.TrimSuffix(string(data), "\n")
-	return lang.NewStr(res), err
+	return c.start()
 }
 
-type CapturedOutput struct {
-	target  io.Writer
-	capture bytes.Buffer
-	quiet   bool
+func fProcWait(args []*lang.Object) (*lang.Object, error) {
+	name, p, err := procArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return waitProc(name, p)
 }
 
-func (o *CapturedOutput) Target(w io.Writer) {
-	o.target = w
+func fProcKill(args []*lang.Object) (*lang.Object, error) {
+	name, p, err := procArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if !p.running() {
+		return lang.NewBool(false), nil
+	}
+
+	lang.Log.Info("killing process", lang.F("process", name))
+
+	if err := p.cmd.Process.Kill(); err != nil && p.running() {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(true), nil
 }
 
-func (o *CapturedOutput) Quiet() {
-	o.quiet = true
+// fProcSignal sends a signal, given by name (like TERM) or number
+func fProcSignal(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need process and signal")
+	}
+	name, p, err := procArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	var sig syscall.Signal
+	if args[1].Type == lang.ObjInt {
+		sig = syscall.Signal(args[1].IntV)
+	} else {
+		sigName := strings.TrimPrefix(strings.ToUpper(args[1].String()), "SIG")
+		var ok bool
+		if sig, ok = signals[sigName]; !ok {
+			return lang.NewNil(), badArg.Get("unknown signal " + args[1].String())
+		}
+	}
+
+	lang.Log.Info("signalling process", lang.F("process", name), lang.F("signal", sig))
+
+	return lang.NewNil(), p.cmd.Process.Signal(sig)
 }
 
-func (o *CapturedOutput) Write(p []byte) (int, error) {
-	if !o.quiet {
-		o.target.Write(p)
+func fProcRunning(args []*lang.Object) (*lang.Object, error) {
+	_, p, err := procArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
 	}
-	return o.capture.Write(p)
+	return lang.NewBool(p.running()), nil
 }
 
-func (o *CapturedOutput) Data() ([]byte, error) {
-	r := bytes.NewReader(o.capture.Bytes())
-	return io.ReadAll(r)
+// fPipe runs commands with the output of each going to the input of the next,
+// like a shell pipeline, and returns the result of the last one
+func fPipe(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need commands")
+	}
+	chain := make([]*exec.Cmd, len(args))
+	for i, arg := range args {
+		cmdArgs, err := commandArgs([]*lang.Object{arg})
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		cmd, _, cancel, err := (&command{args: cmdArgs}).prepare()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		defer cancel()
+		chain[i] = cmd
+	}
+
+	lang.Log.Info("running pipeline", lang.F("commands", len(chain)))
+
+	stdout := &lang.Buffer{}
+	// all the commands write to stderr at the same time
+	stderr := &lockedBuffer{}
+	defer stdout.Release()
+	defer stderr.buf.Release()
+	var pipes []*os.File
+	defer func() {
+		for _, f := range pipes {
+			f.Close()
+		}
+	}()
+	for i, cmd := range chain {
+		cmd.Stderr = stderr
+		if i == len(chain)-1 {
+			cmd.Stdout = stdout
+			break
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		pipes = append(pipes, r, w)
+		cmd.Stdout = w
+		chain[i+1].Stdin = r
+	}
+	started := 0
+	var startErr error
+	for _, cmd := range chain {
+		if startErr = cmd.Start(); startErr != nil {
+			break
+		}
+		started++
+	}
+	// the children have their own copies of the pipes, so closing ours lets
+	// each of them see the end of its input once the previous one exits
+	for _, f := range pipes {
+		f.Close()
+	}
+	pipes = nil
+	codes := make([]*lang.Object, started)
+	ok := true
+	var waitErr error
+	for i, cmd := range chain[:started] {
+		code := 0
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				waitErr = err
+			} else {
+				code = exitErr.ExitCode()
+			}
+		}
+		codes[i] = lang.NewInt(code)
+		ok = ok && code == 0
+	}
+	if startErr != nil {
+		return lang.NewNil(), startErr
+	}
+	if lang.Context().Err() != nil {
+		return lang.NewNil(), lang.Context().Err()
+	}
+	if waitErr != nil {
+		return lang.NewNil(), waitErr
+	}
+	return lang.NewMap(map[string]*lang.Object{
+		"stdout": lang.NewStr(stdout.String()),
+		"stderr": lang.NewStr(stderr.buf.String()),
+		"code":   codes[len(codes)-1],
+		"codes":  lang.NewList(codes),
+		"ok":     lang.NewBool(ok),
+	}), nil
 }
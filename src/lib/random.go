@@ -0,0 +1,230 @@
+package lib
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"mohazit/lang"
+	"sync"
+	"time"
+)
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// randomLock guards random, as rand.Rand is not safe for concurrent use
+var randomLock sync.Mutex
+
+// Seed makes the random numbers of scripts reproducible
+func Seed(seed int64) {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	random = rand.New(rand.NewSource(seed))
+}
+
+// listArg returns the items of the i-th argument, which must be a list
+func listArg(args []*lang.Object, i int) ([]*lang.Object, error) {
+	if len(args) <= i {
+		return nil, moreArgs.Get("need list")
+	}
+	if args[i].Type != lang.ObjList {
+		return nil, badType.Get("argument must be a list")
+	}
+	return args[i].ListV, nil
+}
+
+// numArg returns the i-th argument as a float, which may also be an integer
+func numArg(args []*lang.Object, i int, what string) (float64, error) {
+	if len(args) <= i {
+		return 0, moreArgs.Get("need " + what)
+	}
+	switch args[i].Type {
+	case lang.ObjInt:
+		return float64(args[i].IntV), nil
+	case lang.ObjFloat:
+		return args[i].FloatV, nil
+	}
+	return 0, badType.Get(what + " must be a number")
+}
+
+func fRandom(args []*lang.Object) (*lang.Object, error) {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return &lang.Object{
+		Type: lang.ObjInt,
+		IntV: random.Int(),
+	}, nil
+}
+
+// fLimitedRandom returns a number from 0 up to, but not including, the bound
+func fLimitedRandom(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need bound")
+	}
+	in := args[0]
+	if in.Type != lang.ObjInt {
+		return nil, badType.Get("bound must be an integer")
+	}
+	if in.IntV <= 0 {
+		return nil, badArg.Get("bound must be positive")
+	}
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return &lang.Object{
+		Type: lang.ObjInt,
+		IntV: random.Intn(in.IntV),
+	}, nil
+}
+
+// fRandomRange returns a number from min up to and including max
+func fRandomRange(args []*lang.Object) (*lang.Object, error) {
+	min, err := intArg(args, 0, "minimum")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	max, err := intArg(args, 1, "maximum")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if max < min {
+		return lang.NewNil(), badArg.Get("maximum is less than minimum")
+	}
+	// the span is counted unsigned, as it may not fit in an int
+	span := uint64(max) - uint64(min)
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	var offset uint64
+	if span < math.MaxInt64 {
+		offset = uint64(random.Int63n(int64(span) + 1))
+	} else {
+		// spans this wide hold at least half of all numbers, so few tries are
+		// needed to find one inside of it
+		for offset = random.Uint64(); offset > span; offset = random.Uint64() {
+		}
+	}
+	return lang.NewInt(int(uint64(min) + offset)), nil
+}
+
+// fRandomFloat returns a number from 0, or the given minimum, up to but not
+// including 1, or the given maximum
+func fRandomFloat(args []*lang.Object) (*lang.Object, error) {
+	min, max := 0.0, 1.0
+	if len(args) >= 2 {
+		var err error
+		if min, err = numArg(args, 0, "minimum"); err != nil {
+			return lang.NewNil(), err
+		}
+		if max, err = numArg(args, 1, "maximum"); err != nil {
+			return lang.NewNil(), err
+		}
+		if max < min {
+			return lang.NewNil(), badArg.Get("maximum is less than minimum")
+		}
+	}
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return lang.NewFloat(min + random.Float64()*(max-min)), nil
+}
+
+func fRandomSeed(args []*lang.Object) (*lang.Object, error) {
+	seed, err := intArg(args, 0, "seed")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	Seed(int64(seed))
+	return lang.NewNil(), nil
+}
+
+func fRandomChoice(args []*lang.Object) (*lang.Object, error) {
+	items, err := listArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(items) == 0 {
+		return lang.NewNil(), badArg.Get("cannot choose from an empty list")
+	}
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return items[random.Intn(len(items))], nil
+}
+
+// fShuffle returns the items of a list in a random order, leaving the list
+// itself as it is
+func fShuffle(args []*lang.Object) (*lang.Object, error) {
+	items, err := listArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	shuffled := make([]*lang.Object, len(items))
+	copy(shuffled, items)
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	random.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return lang.NewList(shuffled), nil
+}
+
+// cryptoBytes reads n bytes from the random source of the system, which
+// seeding has no effect on
+func cryptoBytes(args []*lang.Object) ([]byte, error) {
+	n, err := intArg(args, 0, "amount of bytes")
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, badArg.Get("amount of bytes must not be negative")
+	}
+	data := make([]byte, n)
+	if _, err := crand.Read(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fCryptoRandom returns a number from 0 up to, but not including, the bound,
+// which is fit for secrets
+func fCryptoRandom(args []*lang.Object) (*lang.Object, error) {
+	bound, err := intArg(args, 0, "bound")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if bound <= 0 {
+		return lang.NewNil(), badArg.Get("bound must be positive")
+	}
+	n, err := crand.Int(crand.Reader, big.NewInt(int64(bound)))
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewInt(int(n.Int64())), nil
+}
+
+func fCryptoBytes(args []*lang.Object) (*lang.Object, error) {
+	data, err := cryptoBytes(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBytes(data), nil
+}
+
+// fCryptoToken returns n random bytes as hex, for names and passwords
+func fCryptoToken(args []*lang.Object) (*lang.Object, error) {
+	data, err := cryptoBytes(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(hex.EncodeToString(data)), nil
+}
+
+// fUuid returns a random version 4 UUID
+func fUuid(args []*lang.Object) (*lang.Object, error) {
+	var u [16]byte
+	if _, err := crand.Read(u[:]); err != nil {
+		return lang.NewNil(), err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return lang.NewStr(fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])), nil
+}
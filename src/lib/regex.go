@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"mohazit/lang"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var patterns = make(map[string]*regexp.Regexp)
+var patternsLock sync.Mutex
+
+// maxPatterns is how many compiled patterns are kept around, so that patterns
+// built while the script runs don't pile up forever
+const maxPatterns = 256
+
+// compile returns the compiled form of the given pattern, compiling it only
+// the first time it is used while it stays cached
+func compile(pattern string) (*regexp.Regexp, error) {
+	patternsLock.Lock()
+	defer patternsLock.Unlock()
+	if re, ok := patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, badArg.Get("invalid pattern: " + err.Error())
+	}
+	if len(patterns) >= maxPatterns {
+		// forget any one pattern, it is compiled again when used again
+		for p := range patterns {
+			delete(patterns, p)
+			break
+		}
+	}
+	patterns[pattern] = re
+	return re, nil
+}
+
+// reArgs reads the text and pattern arguments shared by all regex built-ins
+func reArgs(args []*lang.Object) (string, *regexp.Regexp, error) {
+	text, err := strArg(args, 0, "text")
+	if err != nil {
+		return "", nil, err
+	}
+	pattern, err := strArg(args, 1, "pattern")
+	if err != nil {
+		return "", nil, err
+	}
+	re, err := compile(pattern)
+	return text, re, err
+}
+
+// groups turns a submatch into a map of its capture groups. Groups are keyed
+// by their index, with named groups also available under their name.
+func groups(re *regexp.Regexp, match []string) *lang.Object {
+	items := make(map[string]*lang.Object, len(match))
+	for i, name := range re.SubexpNames() {
+		items[strconv.Itoa(i)] = lang.NewStr(match[i])
+		if name != "" {
+			items[name] = lang.NewStr(match[i])
+		}
+	}
+	return lang.NewMap(items)
+}
+
+// limitArg reads the optional maximum amount of results
+func limitArg(args []*lang.Object, i int) (int, error) {
+	if len(args) <= i {
+		return -1, nil
+	}
+	return intArg(args, i, "limit")
+}
+
+func fReMatch(args []*lang.Object) (*lang.Object, error) {
+	text, re, err := reArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(re.MatchString(text)), nil
+}
+
+func fReFind(args []*lang.Object) (*lang.Object, error) {
+	text, re, err := reArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	match := re.FindStringSubmatch(text)
+	if match == nil {
+		return lang.NewNil(), nil
+	}
+	return groups(re, match), nil
+}
+
+func fReFindAll(args []*lang.Object) (*lang.Object, error) {
+	text, re, err := reArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	n, err := limitArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	matches := []*lang.Object{}
+	for _, match := range re.FindAllStringSubmatch(text, n) {
+		matches = append(matches, groups(re, match))
+	}
+	return lang.NewList(matches), nil
+}
+
+func fReReplace(args []*lang.Object) (*lang.Object, error) {
+	text, re, err := reArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	repl := ""
+	if len(args) >= 3 {
+		repl = args[2].String()
+	}
+	return lang.NewStr(re.ReplaceAllString(text, repl)), nil
+}
+
+func fReSplit(args []*lang.Object) (*lang.Object, error) {
+	text, re, err := reArgs(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	n, err := limitArg(args, 2)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewObject(re.Split(text, n)), nil
+}
+
+func cMatches(a *lang.Object, b *lang.Object) (bool, error) {
+	re, err := compile(b.String())
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(a.String()), nil
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policy decides what scripts are allowed to do. Every capability group is
+// denied unless it is listed. An entry of `*` allows everything in a group.
+type Policy struct {
+	// Read and Write list the paths that may be read from or written to,
+	// including everything inside of them
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	// Exec lists the programs that may be run, either by name as found in
+	// PATH or by their full path
+	Exec []string `json:"exec"`
+	// Dial and Listen list the addresses that may be connected to or listened
+	// on, as `host:port` where either part may be `*`
+	Dial   []string `json:"dial"`
+	Listen []string `json:"listen"`
+	// Env allows reading and changing environment variables
+	Env bool `json:"env"`
+}
+
+// Sandbox is the policy applied to all built-ins. If nil, everything is
+// allowed.
+var Sandbox *Policy
+
+var denied = LazyError("function: not allowed: %s", "fnc_denied")
+
+// LoadPolicy reads a policy from a JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// resolvePath makes a path absolute and follows symbolic links, so that links
+// can't be used to escape allowed directories. Paths that don't exist yet are
+// resolved through their parent directory.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	dir, base := filepath.Split(abs)
+	if dir == abs {
+		return abs
+	}
+	return filepath.Join(resolvePath(filepath.Clean(dir)), base)
+}
+
+func pathAllowed(allowed []string, path string) bool {
+	target := resolvePath(path)
+	for _, a := range allowed {
+		if a == "*" {
+			return true
+		}
+		root := resolvePath(a)
+		if target == root || strings.HasPrefix(target, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRead checks if the given paths may be read from
+func allowRead(paths ...string) error {
+	if Sandbox == nil {
+		return nil
+	}
+	for _, p := range paths {
+		if !pathAllowed(Sandbox.Read, p) {
+			return denied.Get("reading " + p)
+		}
+	}
+	return nil
+}
+
+// allowWrite checks if the given paths may be written to
+func allowWrite(paths ...string) error {
+	if Sandbox == nil {
+		return nil
+	}
+	for _, p := range paths {
+		if !pathAllowed(Sandbox.Write, p) {
+			return denied.Get("writing " + p)
+		}
+	}
+	return nil
+}
+
+// allowExec checks if the given program may be run. Entries without a path
+// separator only match programs found through PATH.
+func allowExec(name, path string) error {
+	if Sandbox == nil {
+		return nil
+	}
+	for _, e := range Sandbox.Exec {
+		if e == "*" {
+			return nil
+		}
+		if strings.ContainsRune(e, filepath.Separator) || strings.ContainsRune(e, '/') {
+			if resolvePath(e) == resolvePath(path) {
+				return nil
+			}
+		} else if e == name && !strings.ContainsAny(name, `/\`) {
+			return nil
+		}
+	}
+	return denied.Get("running " + name)
+}
+
+func addrAllowed(allowed []string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if a == "*" {
+			return true
+		}
+		aHost, aPort, err := net.SplitHostPort(a)
+		if err != nil {
+			continue
+		}
+		if (aHost == "*" || strings.EqualFold(aHost, host)) && (aPort == "*" || aPort == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowDial checks if the given address may be connected to
+func allowDial(addr string) error {
+	if Sandbox == nil || addrAllowed(Sandbox.Dial, addr) {
+		return nil
+	}
+	return denied.Get("connecting to " + addr)
+}
+
+// allowURL checks if the host of the given URL may be connected to
+func allowURL(u *url.URL) error {
+	if Sandbox == nil {
+		return nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return allowDial(net.JoinHostPort(u.Hostname(), port))
+}
+
+// allowListen checks if the given address may be listened on
+func allowListen(addr string) error {
+	if Sandbox == nil || addrAllowed(Sandbox.Listen, addr) {
+		return nil
+	}
+	return denied.Get("listening on " + addr)
+}
+
+// allowEnv checks if environment variables may be used
+func allowEnv() error {
+	if Sandbox == nil || Sandbox.Env {
+		return nil
+	}
+	return denied.Get("using environment variables")
+}
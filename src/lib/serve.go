@@ -0,0 +1,423 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mohazit/lang"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route maps requests to a label or function handling them, or to a
+// directory of static files
+type route struct {
+	method  string
+	path    string
+	handler string
+	dir     string
+}
+
+// matches checks if the route's path matches the path of a request. A path
+// ending with `*` matches everything starting with it.
+func (r *route) matches(path string) bool {
+	if strings.HasSuffix(r.path, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(r.path, "*"))
+	}
+	return r.path == path
+}
+
+var routes = []*route{}
+
+// pendingRequest is a request waiting to be handled by the script
+type pendingRequest struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	route    *route
+	finished chan struct{}
+}
+
+// httpServer passes requests received by a net/http server on to the script,
+// which handles them one at a time
+type httpServer struct {
+	srv      *http.Server
+	incoming chan *pendingRequest
+	done     chan struct{}
+	shutdown chan error
+}
+
+var servers = make(map[string]*httpServer)
+var serverCount = 0
+var lastServer = ""
+
+// serveLock guards the routes and servers, which are shared by all tasks
+var serveLock sync.Mutex
+
+// response is the response being built by the currently running handler.
+// Handlers run one at a time, even when several tasks are serving requests.
+var response *serverResponse
+var responseLock sync.Mutex
+var handleLock sync.Mutex
+
+type serverResponse struct {
+	status int
+	header http.Header
+	body   lang.Buffer
+}
+
+// maxRequestBody limits how much of a request body is read into memory
+const maxRequestBody = 10 << 20
+
+// shutdownTimeout is how long to wait for active requests when stopping
+const shutdownTimeout = 5 * time.Second
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var found *route
+	methodMismatch := false
+	serveLock.Lock()
+	current := routes
+	serveLock.Unlock()
+	for _, rt := range current {
+		if !rt.matches(r.URL.Path) {
+			continue
+		}
+		if rt.method != "*" && rt.method != r.Method {
+			methodMismatch = true
+			continue
+		}
+		found = rt
+		break
+	}
+	if found == nil {
+		if methodMismatch {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if found.dir != "" {
+		prefix := strings.TrimSuffix(found.path, "*")
+		http.StripPrefix(prefix, http.FileServer(http.Dir(found.dir))).ServeHTTP(w, r)
+		return
+	}
+	req := &pendingRequest{w, r, found, make(chan struct{})}
+	select {
+	case s.incoming <- req:
+	case <-s.done:
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	<-req.finished
+}
+
+// stop stops passing requests to the script and gracefully shuts the server
+// down in the background, as that waits for active requests to finish. This
+// includes the request that may be calling this.
+func (s *httpServer) stop() {
+	serveLock.Lock()
+	defer serveLock.Unlock()
+	if s.shutdown != nil {
+		return
+	}
+	s.shutdown = make(chan error, 1)
+	close(s.done)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		s.shutdown <- s.srv.Shutdown(ctx)
+	}()
+}
+
+// handle runs the handler label of a request and writes the response. Output
+// of the handler goes to out.
+func (s *httpServer) handle(out io.Writer, req *pendingRequest) error {
+	defer close(req.finished)
+	r := req.r
+	// a byte more than allowed is enough to tell the body is too large
+	body, err := lang.ReadAll(http.MaxBytesReader(req.w, r.Body, maxRequestBody+1))
+	var limit *lang.LimitError
+	if len(body) > maxRequestBody || errors.As(err, &limit) {
+		http.Error(req.w, "request body too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	if err != nil {
+		http.Error(req.w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	query := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		query[k] = strings.Join(v, ", ")
+	}
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+	request := lang.NewMap(map[string]*lang.Object{
+		"method":  lang.NewStr(r.Method),
+		"path":    lang.NewStr(r.URL.Path),
+		"query":   lang.NewObject(query),
+		"headers": lang.NewObject(headers),
+		"body":    lang.NewStr(string(body)),
+		"remote":  lang.NewStr(r.RemoteAddr),
+	})
+
+	lang.Log.Info("handling HTTP request", lang.F("method", r.Method), lang.F("url", r.URL))
+
+	handleLock.Lock()
+	defer handleLock.Unlock()
+	resp := &serverResponse{status: http.StatusOK, header: make(http.Header)}
+	defer resp.body.Release()
+	setResponse(resp)
+	defer setResponse(nil)
+	if lang.HasLabel(req.route.handler) {
+		err = lang.CallLabel(req.route.handler, map[string]*lang.Object{
+			"request": request,
+		}, out)
+	} else {
+		// functions get the request as their argument and anything they
+		// return is added to the body
+		var ret *lang.Object
+		if fn, ok := lang.Func(req.route.handler, out); ok {
+			ret, err = fn([]*lang.Object{request})
+		} else {
+			err = badState.Get("no label or function named " + req.route.handler)
+		}
+		if err == nil && ret.Type != lang.ObjNil {
+			err = withResponse(func(r *serverResponse) error {
+				_, err := r.body.WriteString(ret.String())
+				return err
+			})
+		}
+	}
+	if err != nil {
+		http.Error(req.w, "internal server error", http.StatusInternalServerError)
+		if stopsScript(err) {
+			return err
+		}
+		// a broken handler only fails its own request
+		lang.Log.Error("HTTP handler failed", lang.F("method", r.Method),
+			lang.F("url", r.URL), lang.F("error", err))
+		return nil
+	}
+	responseLock.Lock()
+	defer responseLock.Unlock()
+	for k, v := range resp.header {
+		req.w.Header()[k] = v
+	}
+	req.w.WriteHeader(resp.status)
+	_, err = req.w.Write(resp.body.Bytes())
+	return err
+}
+
+// stopsScript checks if an error from a handler should end the script rather
+// than just the request, as it exited or was stopped
+func stopsScript(err error) bool {
+	var exit *lang.Exit
+	var limit *lang.LimitError
+	return errors.As(err, &exit) || errors.As(err, &limit) || lang.Context().Err() != nil
+}
+
+func setResponse(r *serverResponse) {
+	responseLock.Lock()
+	response = r
+	responseLock.Unlock()
+}
+
+// withResponse calls fn with the response being built, failing if no request
+// is being handled
+func withResponse(fn func(r *serverResponse) error) error {
+	responseLock.Lock()
+	defer responseLock.Unlock()
+	if response == nil {
+		return badState.Get("not handling a request")
+	}
+	return fn(response)
+}
+
+// serverArg resolves the server named by the i-th argument, falling back to
+// the last started server
+func serverArg(args []*lang.Object, i int) (*httpServer, error) {
+	serveLock.Lock()
+	defer serveLock.Unlock()
+	serverName := lastServer
+	if len(args) > i {
+		if args[i].Type != lang.ObjStr {
+			return nil, badType.Get("server name must be a string")
+		}
+		serverName = args[i].StrV
+	} else if serverName == "" {
+		return nil, badState.Get("could not infer server name")
+	}
+	s, ok := servers[serverName]
+	if !ok {
+		return nil, badState.Get("no server named `" + serverName + "` exists")
+	}
+	return s, nil
+}
+
+func fRoute(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 3 {
+		return lang.NewNil(), moreArgs.Get("need method, path and handler")
+	}
+	method := strings.ToUpper(args[0].String())
+	if method == "ANY" {
+		method = "*"
+	}
+	handler := args[2].String()
+	if _, ok := lang.Func(handler, nil); !ok && !lang.HasLabel(handler) {
+		return lang.NewNil(), badArg.Get("no label or function named " + handler)
+	}
+	serveLock.Lock()
+	routes = append(routes, &route{method: method, path: args[1].String(), handler: handler})
+	serveLock.Unlock()
+	return lang.NewNil(), nil
+}
+
+func fHttpStatic(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need path and directory")
+	}
+	if err := allowRead(args[1].String()); err != nil {
+		return lang.NewNil(), err
+	}
+	path := args[0].String()
+	if !strings.HasSuffix(path, "*") {
+		path = strings.TrimSuffix(path, "/") + "/*"
+	}
+	serveLock.Lock()
+	routes = append(routes, &route{method: http.MethodGet, path: path, dir: args[1].String()})
+	serveLock.Unlock()
+	return lang.NewNil(), nil
+}
+
+func fHttpListen(args []*lang.Object) (*lang.Object, error) {
+	var serverName string
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need address")
+	}
+	addrObj := args[0]
+	if addrObj.Type != lang.ObjStr {
+		return lang.NewNil(), badType.Get("address must be a string")
+	}
+	if err := allowListen(addrObj.StrV); err != nil {
+		return lang.NewNil(), err
+	}
+	serveLock.Lock()
+	if len(args) >= 2 {
+		serverName = args[1].String()
+	} else {
+		serverName = fmt.Sprintf("server%d", serverCount)
+	}
+	serverCount++
+	serveLock.Unlock()
+
+	l, err := net.Listen("tcp", addrObj.StrV)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Info("serving HTTP", lang.F("addr", l.Addr()), lang.F("server", serverName))
+
+	s := &httpServer{
+		incoming: make(chan *pendingRequest),
+		done:     make(chan struct{}),
+	}
+	s.srv = &http.Server{Handler: s}
+	go s.srv.Serve(l)
+	serveLock.Lock()
+	servers[serverName] = s
+	lastServer = serverName
+	serveLock.Unlock()
+	return lang.NewStr(serverName), nil
+}
+
+func fHttpWait(out io.Writer, args []*lang.Object) (*lang.Object, error) {
+	s, err := serverArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	ctx := lang.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop()
+			return lang.NewNil(), ctx.Err()
+		case req := <-s.incoming:
+			if err := s.handle(out, req); err != nil {
+				s.stop()
+				return lang.NewNil(), err
+			}
+		case <-s.done:
+			return lang.NewNil(), nil
+		}
+	}
+}
+
+func fHttpServe(out io.Writer, args []*lang.Object) (*lang.Object, error) {
+	if _, err := fHttpListen(args); err != nil {
+		return lang.NewNil(), err
+	}
+	return fHttpWait(out, nil)
+}
+
+func fHttpStop(args []*lang.Object) (*lang.Object, error) {
+	s, err := serverArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	s.stop()
+	return lang.NewNil(), nil
+}
+
+func fHttpRespondStatus(args []*lang.Object) (*lang.Object, error) {
+	status, err := intArg(args, 0, "status code")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewNil(), withResponse(func(r *serverResponse) error {
+		r.status = status
+		return nil
+	})
+}
+
+func fHttpRespondHeader(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need header name and value")
+	}
+	return lang.NewNil(), withResponse(func(r *serverResponse) error {
+		r.header.Add(args[0].String(), args[1].String())
+		return nil
+	})
+}
+
+func fHttpRespond(args []*lang.Object) (*lang.Object, error) {
+	return lang.NewNil(), withResponse(func(r *serverResponse) error {
+		for _, o := range args {
+			if _, err := r.body.WriteString(o.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stopServers shuts down all servers still running
+func stopServers() error {
+	serveLock.Lock()
+	running := servers
+	servers = make(map[string]*httpServer)
+	serveLock.Unlock()
+	var firstErr error
+	for _, s := range running {
+		s.stop()
+		if err := <-s.shutdown; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
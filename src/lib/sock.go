@@ -1,14 +1,30 @@
 package lib
 
 import (
-	"fmt"
 	"mohazit/lang"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type NetConnStream struct {
 	conn net.Conn
+	// stop ends the watch for the script being cancelled
+	stop func()
+}
+
+// newNetConnStream wraps a connection, which is interrupted once the script
+// is cancelled
+func newNetConnStream(c net.Conn) *NetConnStream {
+	s := &NetConnStream{conn: c}
+	s.stop = onCancel(s.interrupt)
+	return s
+}
+
+// interrupt makes blocked reads and writes fail
+func (s *NetConnStream) interrupt() {
+	s.conn.SetDeadline(time.Now())
 }
 
 func (s *NetConnStream) Read(p []byte) (int, error) {
@@ -24,11 +40,15 @@ func (s *NetConnStream) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (s *NetConnStream) Close() error {
+	s.stop()
 	return s.conn.Close()
 }
 
 var Listeners = make(map[string]net.Listener)
 
+// ListenersLock guards Listeners, which is shared by all tasks
+var ListenersLock sync.Mutex
+
 func fSockDial(args []*lang.Object) (*lang.Object, error) {
 	var addr string
 	var streamName string
@@ -40,22 +60,24 @@ func fSockDial(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("address must be a string")
 	}
 	addr = addrObj.StrV
+	if err := allowDial(addr); err != nil {
+		return lang.NewNil(), err
+	}
 	if len(args) != 2 {
-		streamName = fmt.Sprintf("socket%d", streamsSoFar)
+		streamName = newStreamName("socket")
 	} else {
 		streamName = args[0].String()
 	}
-	streamsSoFar++
 
-	fmt.Printf("dialing via socket stream `%s`\n", streamName)
+	lang.Log.Info("dialing", lang.F("addr", addr), lang.F("stream", streamName))
 
-	c, err := net.Dial("tcp", addr)
+	var d net.Dialer
+	c, err := d.DialContext(lang.Context(), "tcp", addr)
 	if err != nil {
 		return lang.NewNil(), err
 	}
 
-	streams[streamName] = &NetConnStream{c}
-	lastStream = streamName
+	addStream(streamName, newNetConnStream(c))
 	return lang.NewStr(streamName), nil
 }
 
@@ -70,20 +92,24 @@ func fSockListen(args []*lang.Object) (*lang.Object, error) {
 		return lang.NewNil(), badType.Get("address must be a string")
 	}
 	addr = addrObj.StrV
+	if err := allowListen(addr); err != nil {
+		return lang.NewNil(), err
+	}
 	if len(args) != 2 {
-		sockName = fmt.Sprintf("socket%d", streamsSoFar)
+		sockName = newStreamName("socket")
 	} else {
 		sockName = strings.ToLower(args[1].String())
 	}
-	streamsSoFar++
 
-	fmt.Printf("listening via socket `%s`\n", sockName)
+	lang.Log.Info("listening", lang.F("addr", addr), lang.F("socket", sockName))
 
 	c, err := net.Listen("tcp", addr)
 	if err != nil {
 		return lang.NewNil(), err
 	}
+	ListenersLock.Lock()
 	Listeners[sockName] = c
+	ListenersLock.Unlock()
 	return lang.NewStr(sockName), nil
 }
 
@@ -98,21 +124,24 @@ func fSockAccept(args []*lang.Object) (*lang.Object, error) {
 	}
 	sockName = sockNameObj.StrV
 
+	ListenersLock.Lock()
 	l, ok := Listeners[sockName]
+	ListenersLock.Unlock()
 	if !ok {
 		return lang.NewNil(), badState.Get("socket does not exist: " + sockName)
 	}
+	// the listener can't be used anymore once the script is cancelled
+	done := onCancel(func() { l.Close() })
 	c, err := l.Accept()
+	done()
 	if err != nil {
 		return lang.NewNil(), err
 	}
 
-	sockName = fmt.Sprintf("socket%d", streamsSoFar)
-	streams[sockName] = &NetConnStream{c}
-	streamsSoFar++
-	lastStream = sockName
+	sockName = newStreamName("socket")
+	addStream(sockName, newNetConnStream(c))
 
-	fmt.Printf("receievd connection: socket stream `%s`\n", sockName)
+	lang.Log.Info("received connection", lang.F("stream", sockName), lang.F("remote", c.RemoteAddr()))
 
 	return lang.NewStr(sockName), nil
 }
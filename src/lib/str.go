@@ -0,0 +1,391 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"mohazit/lang"
+	"strings"
+	"unicode"
+)
+
+// strArg returns the i-th argument as a string, converting non-string objects
+func strArg(args []*lang.Object, i int, what string) (string, error) {
+	if len(args) <= i {
+		return "", moreArgs.Get("need " + what)
+	}
+	return args[i].String(), nil
+}
+
+// intArg returns the i-th argument, which must be an integer
+func intArg(args []*lang.Object, i int, what string) (int, error) {
+	if len(args) <= i {
+		return 0, moreArgs.Get("need " + what)
+	}
+	if args[i].Type != lang.ObjInt {
+		return 0, badType.Get(what + " must be an integer")
+	}
+	return args[i].IntV, nil
+}
+
+// clampIndex turns a possibly negative index into a valid position in a
+// sequence of the given length
+func clampIndex(idx, length int) int {
+	if idx < 0 {
+		idx += length
+	}
+	if idx < 0 {
+		return 0
+	}
+	if idx > length {
+		return length
+	}
+	return idx
+}
+
+func fStrLen(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewInt(len([]rune(s))), nil
+}
+
+func fStrUpper(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(strings.ToUpper(s)), nil
+}
+
+func fStrLower(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(strings.ToLower(s)), nil
+}
+
+func fStrTitle(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	out := []rune(s)
+	start := true
+	for i, r := range out {
+		if unicode.IsSpace(r) {
+			start = true
+			continue
+		}
+		if start {
+			out[i] = unicode.ToUpper(r)
+		} else {
+			out[i] = unicode.ToLower(r)
+		}
+		start = false
+	}
+	return lang.NewStr(string(out)), nil
+}
+
+func fStrTrim(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) >= 2 {
+		return lang.NewStr(strings.Trim(s, args[1].String())), nil
+	}
+	return lang.NewStr(strings.TrimSpace(s)), nil
+}
+
+func fStrTrimLeft(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) >= 2 {
+		return lang.NewStr(strings.TrimLeft(s, args[1].String())), nil
+	}
+	return lang.NewStr(strings.TrimLeftFunc(s, unicode.IsSpace)), nil
+}
+
+func fStrTrimRight(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) >= 2 {
+		return lang.NewStr(strings.TrimRight(s, args[1].String())), nil
+	}
+	return lang.NewStr(strings.TrimRightFunc(s, unicode.IsSpace)), nil
+}
+
+func fStrTrimPrefix(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	prefix, err := strArg(args, 1, "prefix")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(strings.TrimPrefix(s, prefix)), nil
+}
+
+func fStrTrimSuffix(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	suffix, err := strArg(args, 1, "suffix")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(strings.TrimSuffix(s, suffix)), nil
+}
+
+func fStrContains(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	sub, err := strArg(args, 1, "substring")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(strings.Contains(s, sub)), nil
+}
+
+func fStrStartsWith(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	prefix, err := strArg(args, 1, "prefix")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(strings.HasPrefix(s, prefix)), nil
+}
+
+func fStrEndsWith(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	suffix, err := strArg(args, 1, "suffix")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(strings.HasSuffix(s, suffix)), nil
+}
+
+func fStrIndexOf(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	sub, err := strArg(args, 1, "substring")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	idx := strings.Index(s, sub)
+	if idx < 0 {
+		return lang.NewInt(-1), nil
+	}
+	// report the position in characters rather than bytes
+	return lang.NewInt(len([]rune(s[:idx]))), nil
+}
+
+func fStrSub(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	start, err := intArg(args, 1, "start")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	r := []rune(s)
+	end := len(r)
+	if len(args) >= 3 {
+		end, err = intArg(args, 2, "end")
+		if err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	start = clampIndex(start, len(r))
+	end = clampIndex(end, len(r))
+	if start >= end {
+		return lang.NewStr(""), nil
+	}
+	return lang.NewStr(string(r[start:end])), nil
+}
+
+func fStrReplace(args []*lang.Object) (*lang.Object, error) {
+	return strReplace(args, 1)
+}
+
+func fStrReplaceAll(args []*lang.Object) (*lang.Object, error) {
+	return strReplace(args, -1)
+}
+
+func strReplace(args []*lang.Object, n int) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	old, err := strArg(args, 1, "text to replace")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	repl := ""
+	if len(args) >= 3 {
+		repl = args[2].String()
+	}
+	return lang.NewStr(strings.Replace(s, old, repl, n)), nil
+}
+
+func fStrSplit(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewObject(strings.Fields(s)), nil
+	}
+	return lang.NewObject(strings.Split(s, args[1].String())), nil
+}
+
+func fStrJoin(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need list")
+	}
+	listObj := args[0]
+	if listObj.Type != lang.ObjList {
+		return lang.NewNil(), badType.Get("first argument must be a list")
+	}
+	sep := ""
+	if len(args) >= 2 {
+		sep = args[1].String()
+	}
+	parts := make([]string, len(listObj.ListV))
+	for i, o := range listObj.ListV {
+		parts[i] = o.String()
+	}
+	return lang.NewStr(strings.Join(parts, sep)), nil
+}
+
+func fStrRepeat(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	n, err := intArg(args, 1, "count")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if n < 0 {
+		return lang.NewNil(), badArg.Get("count must not be negative")
+	}
+	if len(s) > 0 && n > math.MaxInt/len(s) {
+		return lang.NewNil(), badArg.Get("repeated text would be too long")
+	}
+	// the result is held while it is built, like other buffers
+	size := len(s) * n
+	if err := lang.Reserve(size); err != nil {
+		return lang.NewNil(), err
+	}
+	defer lang.Release(size)
+	return lang.NewStr(strings.Repeat(s, n)), nil
+}
+
+func fStrPadLeft(args []*lang.Object) (*lang.Object, error) {
+	return strPad(args, true)
+}
+
+func fStrPadRight(args []*lang.Object) (*lang.Object, error) {
+	return strPad(args, false)
+}
+
+func strPad(args []*lang.Object, left bool) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	width, err := intArg(args, 1, "width")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	pad := " "
+	if len(args) >= 3 {
+		pad = args[2].String()
+		if len(pad) == 0 {
+			return lang.NewNil(), badArg.Get("padding must not be empty")
+		}
+	}
+	fill := []rune{}
+	padRunes := []rune(pad)
+	for i := len([]rune(s)); i < width; i++ {
+		fill = append(fill, padRunes[len(fill)%len(padRunes)])
+	}
+	if left {
+		return lang.NewStr(string(fill) + s), nil
+	}
+	return lang.NewStr(s + string(fill)), nil
+}
+
+func fStrReverse(args []*lang.Object) (*lang.Object, error) {
+	s, err := strArg(args, 0, "input")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return lang.NewStr(string(r)), nil
+}
+
+func fFormat(args []*lang.Object) (*lang.Object, error) {
+	format, err := strArg(args, 0, "format")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	values := make([]interface{}, len(args)-1)
+	for i, o := range args[1:] {
+		values[i] = goValue(o)
+	}
+	return lang.NewStr(fmt.Sprintf(format, values...)), nil
+}
+
+// goValue converts an object to the closest native Go value
+func goValue(o *lang.Object) interface{} {
+	switch o.Type {
+	case lang.ObjNil:
+		return nil
+	case lang.ObjInt:
+		return o.IntV
+	case lang.ObjFloat:
+		return o.FloatV
+	case lang.ObjBool:
+		return o.BoolV
+	case lang.ObjList:
+		items := make([]interface{}, len(o.ListV))
+		for i, v := range o.ListV {
+			items[i] = goValue(v)
+		}
+		return items
+	case lang.ObjMap:
+		items := make(map[string]interface{}, len(o.MapV))
+		for k, v := range o.MapV {
+			items[k] = goValue(v)
+		}
+		return items
+	case lang.ObjBytes:
+		// encoded as base64 in JSON
+		return o.BytesV
+	}
+	return o.String()
+}
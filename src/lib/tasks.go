@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"mohazit/lang"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// task is a label or function running in its own goroutine
+type task struct {
+	done   chan struct{}
+	result *lang.Object
+	err    error
+}
+
+var tasks = make(map[string]*task)
+var taskCount = 0
+var tasksLock sync.Mutex
+
+// channel passes objects between tasks. The items channel is never closed, so
+// that sending to a closed channel is an error rather than a panic.
+type channel struct {
+	items  chan *lang.Object
+	closed chan struct{}
+	once   sync.Once
+}
+
+var chans = make(map[string]*channel)
+var chanCount = 0
+var chansLock sync.Mutex
+
+// locks are named mutexes, with a locked mutex holding a value
+var locks = make(map[string]chan struct{})
+var locksLock sync.Mutex
+
+func (c *channel) send(o *lang.Object) error {
+	select {
+	case <-c.closed:
+		return badState.Get("channel is closed")
+	default:
+	}
+	select {
+	case c.items <- o:
+		return nil
+	case <-c.closed:
+		return badState.Get("channel is closed")
+	case <-lang.Context().Done():
+		return lang.Context().Err()
+	}
+}
+
+// recv waits for the next value, returning false once the channel is closed
+// and all values sent before closing it have been received
+func (c *channel) recv() (*lang.Object, bool, error) {
+	select {
+	case o := <-c.items:
+		return o, true, nil
+	case <-c.closed:
+	case <-lang.Context().Done():
+		return lang.NewNil(), false, lang.Context().Err()
+	}
+	o, ok := c.drain()
+	return o, ok, nil
+}
+
+func (c *channel) drain() (*lang.Object, bool) {
+	select {
+	case o := <-c.items:
+		return o, true
+	default:
+		return lang.NewNil(), false
+	}
+}
+
+// chanArg resolves the channel named by the i-th argument
+func chanArg(args []*lang.Object, i int) (string, *channel, error) {
+	name, err := strArg(args, i, "channel name")
+	if err != nil {
+		return "", nil, err
+	}
+	chansLock.Lock()
+	defer chansLock.Unlock()
+	c, ok := chans[name]
+	if !ok {
+		return "", nil, badState.Get("no channel named `" + name + "` exists")
+	}
+	return name, c, nil
+}
+
+// fSpawn runs a label or function in a new task. The task writes its output to
+// where the spawning statement would have.
+func fSpawn(out io.Writer, args []*lang.Object) (*lang.Object, error) {
+	name, err := strArg(args, 0, "label or function name")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	fn, isFunc := lang.Func(name, out)
+	if !isFunc && !lang.HasLabel(name) {
+		return lang.NewNil(), badArg.Get("no label or function named " + name)
+	}
+	rest := args[1:]
+
+	tasksLock.Lock()
+	taskName := fmt.Sprintf("task%d", taskCount)
+	taskCount++
+	t := &task{done: make(chan struct{})}
+	tasks[taskName] = t
+	tasksLock.Unlock()
+
+	lang.Log.Info("spawning task", lang.F("task", taskName), lang.F("run", name))
+
+	go func() {
+		defer close(t.done)
+		if lang.HasLabel(name) {
+			// labels get a fresh scope, with the extra arguments in {args}
+			t.result = lang.NewNil()
+			t.err = lang.CallLabel(name, map[string]*lang.Object{
+				"args": lang.NewList(rest),
+			}, out)
+			return
+		}
+		t.result, t.err = fn(rest)
+	}()
+	return lang.NewStr(taskName), nil
+}
+
+// waitTask waits for a task to finish and forgets about it
+func waitTask(name string) (*lang.Object, error) {
+	tasksLock.Lock()
+	t, ok := tasks[name]
+	tasksLock.Unlock()
+	if !ok {
+		return nil, badState.Get("no task named `" + name + "` exists")
+	}
+	select {
+	case <-t.done:
+	case <-lang.Context().Done():
+		return nil, lang.Interrupted(lang.Context().Err())
+	}
+	tasksLock.Lock()
+	delete(tasks, name)
+	tasksLock.Unlock()
+	return t.result, t.err
+}
+
+// waitTasks waits for all tasks, including ones spawned while waiting, and
+// returns the first error
+func waitTasks() error {
+	var firstErr error
+	for {
+		tasksLock.Lock()
+		names := make([]string, 0, len(tasks))
+		for name := range tasks {
+			names = append(names, name)
+		}
+		tasksLock.Unlock()
+		if len(names) == 0 {
+			return firstErr
+		}
+		for _, name := range names {
+			if _, err := waitTask(name); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
+
+func fWait(args []*lang.Object) (*lang.Object, error) {
+	if len(args) == 0 {
+		return lang.NewNil(), waitTasks()
+	}
+	results := make([]*lang.Object, len(args))
+	for i := range args {
+		name, err := strArg(args, i, "task name")
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		results[i], err = waitTask(name)
+		if err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return lang.NewList(results), nil
+}
+
+func fChanMake(args []*lang.Object) (*lang.Object, error) {
+	size := 0
+	if len(args) >= 1 {
+		var err error
+		if size, err = intArg(args, 0, "capacity"); err != nil {
+			return lang.NewNil(), err
+		}
+		if size < 0 {
+			return lang.NewNil(), badArg.Get("capacity must not be negative")
+		}
+	}
+	chansLock.Lock()
+	defer chansLock.Unlock()
+	var name string
+	if len(args) >= 2 {
+		name = args[1].String()
+	} else {
+		name = fmt.Sprintf("chan%d", chanCount)
+	}
+	chanCount++
+	chans[name] = &channel{
+		items:  make(chan *lang.Object, size),
+		closed: make(chan struct{}),
+	}
+	return lang.NewStr(name), nil
+}
+
+func fChanSend(args []*lang.Object) (*lang.Object, error) {
+	_, c, err := chanArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need value to send")
+	}
+	return lang.NewNil(), c.send(args[1])
+}
+
+func fChanRecv(args []*lang.Object) (*lang.Object, error) {
+	_, c, err := chanArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	o, _, err := c.recv()
+	return o, err
+}
+
+func fChanClose(args []*lang.Object) (*lang.Object, error) {
+	name, c, err := chanArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	closed := false
+	c.once.Do(func() {
+		close(c.closed)
+		closed = true
+	})
+	if !closed {
+		return lang.NewNil(), badState.Get("channel `" + name + "` is already closed")
+	}
+	return lang.NewNil(), nil
+}
+
+// fSelect waits for a value from any of the given channels. A trailing
+// integer is a timeout in milliseconds, after which nil is returned.
+func fSelect(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need channel names")
+	}
+	var timeout <-chan time.Time
+	if last := args[len(args)-1]; last.Type == lang.ObjInt {
+		timeout = time.After(time.Duration(last.IntV) * time.Millisecond)
+		args = args[:len(args)-1]
+	}
+	names := make([]string, len(args))
+	picked := make([]*channel, len(args))
+	cases := make([]reflect.SelectCase, 0, len(args)*2+1)
+	for i := range args {
+		name, c, err := chanArg(args, i)
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		names[i] = name
+		picked[i] = c
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.items)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.closed)},
+		)
+	}
+	ctx := lang.Context()
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	if timeout != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timeout)})
+	}
+	chosen, v, _ := reflect.Select(cases)
+	if chosen == len(args)*2 {
+		return lang.NewNil(), ctx.Err()
+	}
+	if chosen == len(args)*2+1 {
+		return lang.NewNil(), nil
+	}
+	i := chosen / 2
+	o, ok := lang.NewNil(), true
+	if chosen%2 == 0 {
+		o = v.Interface().(*lang.Object)
+	} else {
+		o, ok = picked[i].drain()
+	}
+	return lang.NewMap(map[string]*lang.Object{
+		"channel": lang.NewStr(names[i]),
+		"value":   o,
+		"ok":      lang.NewBool(ok),
+	}), nil
+}
+
+// lockArg returns the named mutex, creating it when first used
+func lockArg(args []*lang.Object) (chan struct{}, error) {
+	name, err := strArg(args, 0, "lock name")
+	if err != nil {
+		return nil, err
+	}
+	locksLock.Lock()
+	defer locksLock.Unlock()
+	l, ok := locks[name]
+	if !ok {
+		l = make(chan struct{}, 1)
+		locks[name] = l
+	}
+	return l, nil
+}
+
+func fLock(args []*lang.Object) (*lang.Object, error) {
+	l, err := lockArg(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	select {
+	case l <- struct{}{}:
+		return lang.NewNil(), nil
+	case <-lang.Context().Done():
+		return lang.NewNil(), lang.Context().Err()
+	}
+}
+
+func fUnlock(args []*lang.Object) (*lang.Object, error) {
+	l, err := lockArg(args)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	select {
+	case <-l:
+		return lang.NewNil(), nil
+	default:
+		return lang.NewNil(), badState.Get("lock `" + args[0].String() + "` is not locked")
+	}
+}
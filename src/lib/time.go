@@ -0,0 +1,254 @@
+package lib
+
+import (
+	"mohazit/lang"
+	"strings"
+	"time"
+)
+
+// Times are passed around as text in RFC 3339 format, with nanoseconds, but
+// built-ins also take them as seconds since the unix epoch. Durations are
+// text like 1h30m or 250ms, or an integer amount of milliseconds.
+
+// started is when the script started, for elapsed
+var started time.Time
+
+// layouts are the names of common time formats. Anything else is taken as a
+// layout in the format of the time package, like 2006-01-02 15:04.
+var layouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc822":      time.RFC822,
+	"ansic":       time.ANSIC,
+	"kitchen":     time.Kitchen,
+	"date":        "2006-01-02",
+	"time":        "15:04:05",
+	"datetime":    "2006-01-02 15:04:05",
+}
+
+func layoutOf(name string) string {
+	if layout, ok := layouts[strings.ToLower(name)]; ok {
+		return layout
+	}
+	return name
+}
+
+func timeObj(t time.Time) *lang.Object {
+	return lang.NewStr(t.Format(time.RFC3339Nano))
+}
+
+// timeArg reads the i-th argument as a time
+func timeArg(args []*lang.Object, i int) (time.Time, error) {
+	if len(args) <= i {
+		return time.Time{}, moreArgs.Get("need time")
+	}
+	switch args[i].Type {
+	case lang.ObjInt:
+		return time.Unix(int64(args[i].IntV), 0), nil
+	case lang.ObjStr:
+		t, err := time.Parse(time.RFC3339Nano, args[i].StrV)
+		if err != nil {
+			return time.Time{}, badArg.Get("not a time: " + args[i].StrV)
+		}
+		return t, nil
+	}
+	return time.Time{}, badType.Get("time must be text or seconds since the unix epoch")
+}
+
+// durationArg reads the i-th argument as a duration
+func durationArg(args []*lang.Object, i int) (time.Duration, error) {
+	if len(args) <= i {
+		return 0, moreArgs.Get("need duration")
+	}
+	switch args[i].Type {
+	case lang.ObjInt:
+		return time.Duration(args[i].IntV) * time.Millisecond, nil
+	case lang.ObjStr:
+		d, err := time.ParseDuration(args[i].StrV)
+		if err != nil {
+			return 0, badArg.Get("not a duration: " + args[i].StrV)
+		}
+		return d, nil
+	}
+	return 0, badType.Get("duration must be text or milliseconds")
+}
+
+func fNow(args []*lang.Object) (*lang.Object, error) {
+	return timeObj(lang.Time.Now()), nil
+}
+
+// fUnixTime returns a time, or the current time, in seconds since the unix
+// epoch
+func fUnixTime(args []*lang.Object) (*lang.Object, error) {
+	t := lang.Time.Now()
+	if len(args) >= 1 {
+		var err error
+		if t, err = timeArg(args, 0); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	return lang.NewInt(int(t.Unix())), nil
+}
+
+func fFromUnix(args []*lang.Object) (*lang.Object, error) {
+	secs, err := intArg(args, 0, "seconds since the unix epoch")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return timeObj(time.Unix(int64(secs), 0)), nil
+}
+
+func fTimeFormat(args []*lang.Object) (*lang.Object, error) {
+	t, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	layout, err := strArg(args, 1, "layout")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(t.Format(layoutOf(layout))), nil
+}
+
+// fTimeParse reads a time written in the given layout, which is rfc3339 when
+// left out. Times without a zone are taken as local time.
+func fTimeParse(args []*lang.Object) (*lang.Object, error) {
+	text, err := strArg(args, 0, "text to parse")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	layout := time.RFC3339
+	if len(args) >= 2 {
+		layout = layoutOf(args[1].String())
+	}
+	t, err := time.ParseInLocation(layout, text, time.Local)
+	if err != nil {
+		return lang.NewNil(), badArg.Get("could not parse time " + text)
+	}
+	return timeObj(t), nil
+}
+
+// fTimeFields splits a time into its parts, in the zone it was written in
+func fTimeFields(args []*lang.Object) (*lang.Object, error) {
+	t, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	zone, _ := t.Zone()
+	return lang.NewMap(map[string]*lang.Object{
+		"year":    lang.NewInt(t.Year()),
+		"month":   lang.NewInt(int(t.Month())),
+		"day":     lang.NewInt(t.Day()),
+		"hour":    lang.NewInt(t.Hour()),
+		"minute":  lang.NewInt(t.Minute()),
+		"second":  lang.NewInt(t.Second()),
+		"weekday": lang.NewStr(t.Weekday().String()),
+		"yearday": lang.NewInt(t.YearDay()),
+		"zone":    lang.NewStr(zone),
+	}), nil
+}
+
+func fTimeAdd(args []*lang.Object) (*lang.Object, error) {
+	t, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	d, err := durationArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return timeObj(t.Add(d)), nil
+}
+
+// fTimeAddDate adds years, months and days, which may be negative. Days past
+// the end of a month roll over into the next one.
+func fTimeAddDate(args []*lang.Object) (*lang.Object, error) {
+	t, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	years, err := intArg(args, 1, "years")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	months, days := 0, 0
+	if len(args) >= 3 {
+		if months, err = intArg(args, 2, "months"); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	if len(args) >= 4 {
+		if days, err = intArg(args, 3, "days"); err != nil {
+			return lang.NewNil(), err
+		}
+	}
+	return timeObj(t.AddDate(years, months, days)), nil
+}
+
+// fTimeSub returns the duration from the second time to the first
+func fTimeSub(args []*lang.Object) (*lang.Object, error) {
+	a, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	b, err := timeArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(a.Sub(b).String()), nil
+}
+
+func fTimeBefore(args []*lang.Object) (*lang.Object, error) {
+	a, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	b, err := timeArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewBool(a.Before(b)), nil
+}
+
+// fDuration writes a duration the same way all built-ins return them
+func fDuration(args []*lang.Object) (*lang.Object, error) {
+	d, err := durationArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(d.String()), nil
+}
+
+func fDurationMs(args []*lang.Object) (*lang.Object, error) {
+	d, err := durationArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewInt(int(d.Milliseconds())), nil
+}
+
+func fSleep(args []*lang.Object) (*lang.Object, error) {
+	d, err := durationArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+
+	lang.Log.Debug("sleeping", lang.F("duration", d.String()))
+
+	return lang.NewNil(), lang.Time.Sleep(lang.Context(), d)
+}
+
+// fSince returns how long ago a time was
+func fSince(args []*lang.Object) (*lang.Object, error) {
+	t, err := timeArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(lang.Time.Now().Sub(t).String()), nil
+}
+
+// fElapsed returns how long the script has been running
+func fElapsed(args []*lang.Object) (*lang.Object, error) {
+	return lang.NewStr(lang.Time.Now().Sub(started).String()), nil
+}
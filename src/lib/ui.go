@@ -1,22 +1,197 @@
 package lib
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"mohazit/lang"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
 )
 
-func fSay(args []*lang.Object) (*lang.Object, error) {
+func fSay(out io.Writer, args []*lang.Object) (*lang.Object, error) {
 	for _, o := range args {
-		fmt.Print(o.String(), " ")
+		fmt.Fprint(out, o.String(), " ")
 	}
-	fmt.Print("\n")
+	fmt.Fprint(out, "\n")
 	return lang.NewNil(), nil
 }
 
-func fTypeOf(args []*lang.Object) (*lang.Object, error) {
+func fTypeOf(out io.Writer, args []*lang.Object) (*lang.Object, error) {
 	for _, o := range args {
-		fmt.Print(o.Type.String(), " ")
+		fmt.Fprint(out, o.Type.String(), " ")
 	}
-	fmt.Print("\n")
+	fmt.Fprint(out, "\n")
 	return lang.NewNil(), nil
 }
+
+var input *bufio.Reader
+var inputSource io.Reader
+var inputLock sync.Mutex
+
+// stdin returns a buffered reader over lang.Stdin. The reader is shared
+// between calls so that no piped input is lost to buffering.
+func stdin() *bufio.Reader {
+	inputLock.Lock()
+	defer inputLock.Unlock()
+	if input == nil || inputSource != lang.Stdin {
+		inputSource = lang.Stdin
+		input = bufio.NewReader(lang.Stdin)
+	}
+	return input
+}
+
+// stdinTerminal returns the file descriptor of the standard input if it is a
+// terminal
+func stdinTerminal() (int, bool) {
+	f, ok := lang.Stdin.(*os.File)
+	if !ok {
+		return 0, false
+	}
+	fd := int(f.Fd())
+	return fd, term.IsTerminal(fd)
+}
+
+// prompt shows the prompt built from the given arguments
+func prompt(args []*lang.Object) {
+	txt := []string{}
+	for _, o := range args {
+		txt = append(txt, o.String())
+	}
+	if len(txt) > 0 {
+		fmt.Fprint(lang.Stdout, strings.Join(txt, " "), " ")
+	}
+}
+
+// readLine reads a single line of input, without the line terminator
+func readLine() (string, error) {
+	line, err := stdin().ReadString('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return "", badState.Get("no more input")
+		}
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func fAsk(args []*lang.Object) (*lang.Object, error) {
+	prompt(args)
+	line, err := readLine()
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(line), nil
+}
+
+func fAskSecret(args []*lang.Object) (*lang.Object, error) {
+	prompt(args)
+	fd, ok := stdinTerminal()
+	if !ok {
+		line, err := readLine()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		return lang.NewStr(line), nil
+	}
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprint(lang.Stdout, "\n")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	return lang.NewStr(string(secret)), nil
+}
+
+func fAskNumber(args []*lang.Object) (*lang.Object, error) {
+	for {
+		prompt(args)
+		line, err := readLine()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		line = strings.TrimSpace(line)
+		if i, err := strconv.Atoi(line); err == nil {
+			return lang.NewInt(i), nil
+		}
+		if f, err := strconv.ParseFloat(line, 64); err == nil {
+			return lang.NewFloat(f), nil
+		}
+		fmt.Fprintf(lang.Stdout, "`%s` is not a number, try again\n", line)
+	}
+}
+
+func fConfirm(args []*lang.Object) (*lang.Object, error) {
+	// the last argument may be the default answer
+	var def *lang.Object
+	if len(args) > 0 && args[len(args)-1].Type == lang.ObjBool {
+		def = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+	hint := "[y/n]"
+	if def != nil {
+		if def.BoolV {
+			hint = "[Y/n]"
+		} else {
+			hint = "[y/N]"
+		}
+	}
+	promptArgs := append([]*lang.Object{}, args...)
+	promptArgs = append(promptArgs, lang.NewStr(hint))
+	for {
+		prompt(promptArgs)
+		line, err := readLine()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes", "true":
+			return lang.NewBool(true), nil
+		case "n", "no", "false":
+			return lang.NewBool(false), nil
+		case "":
+			if def != nil {
+				return def, nil
+			}
+		}
+		fmt.Fprintln(lang.Stdout, "please answer yes or no")
+	}
+}
+
+func fChoose(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 2 {
+		return lang.NewNil(), moreArgs.Get("need prompt and options")
+	}
+	options := args[1:]
+	if len(options) == 1 && options[0].Type == lang.ObjList {
+		options = options[0].ListV
+	}
+	if len(options) == 0 {
+		return lang.NewNil(), badArg.Get("need at least one option")
+	}
+	for {
+		fmt.Fprintln(lang.Stdout, args[0].String())
+		for i, o := range options {
+			fmt.Fprintf(lang.Stdout, "  %d) %s\n", i+1, o.String())
+		}
+		prompt([]*lang.Object{lang.NewStr(">")})
+		line, err := readLine()
+		if err != nil {
+			return lang.NewNil(), err
+		}
+		line = strings.TrimSpace(line)
+		if i, err := strconv.Atoi(line); err == nil && i >= 1 && i <= len(options) {
+			return options[i-1], nil
+		}
+		for _, o := range options {
+			if strings.EqualFold(o.String(), line) {
+				return o, nil
+			}
+		}
+		fmt.Fprintf(lang.Stdout, "`%s` is not one of the options, try again\n", line)
+	}
+}
@@ -1,6 +1,10 @@
 package lib
 
-import "fmt"
+import (
+	"fmt"
+	"mohazit/lang"
+	"sync"
+)
 
 type genericError struct {
 	msg   string
@@ -47,3 +51,19 @@ var (
 	badState = LazyError("function: unexpected: %s", "fnc_badstate")
 	badArg   = LazyError("function: bad argument: %s", "fnc_badarg")
 )
+
+// onCancel calls abort if the script is cancelled before the returned function
+// is called. It is used to interrupt calls that can't take a context.
+func onCancel(abort func()) (done func()) {
+	ctx := lang.Context()
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort()
+		case <-finished:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(finished) }) }
+}
@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"mohazit/lang"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileState is what a watcher remembers about a file to notice it changing
+type fileState struct {
+	size  int64
+	mtime time.Time
+}
+
+// watchEvent is a change to a single file, with the type being one of
+// create, modify or delete
+type watchEvent struct {
+	kind string
+	path string
+}
+
+func (e watchEvent) object() *lang.Object {
+	return lang.NewMap(map[string]*lang.Object{
+		"type": lang.NewStr(e.kind),
+		"path": lang.NewStr(e.path),
+	})
+}
+
+// watcher polls a directory for changes to files matching a pattern and
+// passes them on to the script, which handles them one at a time. Changes
+// are only passed on once the directory has been quiet for the debounce
+// time, so that a file being written in several steps is a single event.
+type watcher struct {
+	root     string
+	pattern  string
+	handler  string
+	interval time.Duration
+	debounce time.Duration
+	incoming chan []watchEvent
+	done     chan struct{}
+	once     sync.Once
+}
+
+var watchers = make(map[string]*watcher)
+var watcherCount = 0
+var lastWatcher = ""
+var watchLock sync.Mutex
+
+// defaults for new watchers, in milliseconds
+const defaultWatchInterval = 250
+const defaultWatchDebounce = 100
+
+// matches checks a path relative to the watched directory against the
+// pattern. Patterns without a slash only look at the file name. Patterns are
+// matched against slash separated paths on every system.
+func (w *watcher) matches(rel string) bool {
+	if w.pattern == "" {
+		return true
+	}
+	target := filepath.Base(rel)
+	if strings.Contains(w.pattern, "/") {
+		target = filepath.ToSlash(rel)
+	}
+	ok, _ := path.Match(w.pattern, target)
+	return ok
+}
+
+// scan records the state of every matching file under the watched directory.
+// Files that vanish while scanning are simply left out.
+func (w *watcher) scan() map[string]fileState {
+	files := make(map[string]fileState)
+	filepath.WalkDir(w.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, p)
+		if err != nil || !w.matches(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[p] = fileState{info.Size(), info.ModTime()}
+		return nil
+	})
+	return files
+}
+
+// merge adds a change to the changes not yet passed on, so that a file which
+// is created and then modified is still only created, and one that is
+// created and deleted again never shows up at all
+func merge(pending map[string]string, path, kind string) {
+	prev, ok := pending[path]
+	switch {
+	case !ok:
+		pending[path] = kind
+	case prev == "create" && kind == "delete":
+		delete(pending, path)
+	case prev == "create":
+	case prev == "delete" && kind == "create":
+		pending[path] = "modify"
+	default:
+		pending[path] = kind
+	}
+}
+
+// poll runs until the watcher is stopped, comparing the directory with what
+// it looked like before
+func (w *watcher) poll(before map[string]fileState) {
+	pending := make(map[string]string)
+	var lastChange time.Time
+	for {
+		watchLock.Lock()
+		interval, debounce := w.interval, w.debounce
+		watchLock.Unlock()
+		select {
+		case <-w.done:
+			return
+		case <-time.After(interval):
+		}
+		after := w.scan()
+		changed := false
+		for p, st := range after {
+			old, ok := before[p]
+			if !ok {
+				merge(pending, p, "create")
+				changed = true
+			} else if old != st {
+				merge(pending, p, "modify")
+				changed = true
+			}
+		}
+		for p := range before {
+			if _, ok := after[p]; !ok {
+				merge(pending, p, "delete")
+				changed = true
+			}
+		}
+		before = after
+		if changed {
+			lastChange = time.Now()
+		}
+		if len(pending) == 0 || time.Since(lastChange) < debounce {
+			continue
+		}
+		events := make([]watchEvent, 0, len(pending))
+		for p, kind := range pending {
+			events = append(events, watchEvent{kind, p})
+		}
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].path < events[j].path
+		})
+		pending = make(map[string]string)
+		select {
+		case w.incoming <- events:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *watcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// handle runs the handler label or function for each of the events, writing
+// their output to out
+func (w *watcher) handle(out io.Writer, events []watchEvent) error {
+	for _, e := range events {
+		lang.Log.Info("handling file change", lang.F("type", e.kind), lang.F("file", e.path))
+
+		var err error
+		if lang.HasLabel(w.handler) {
+			err = lang.CallLabel(w.handler, map[string]*lang.Object{
+				"event": e.object(),
+			}, out)
+		} else if fn, ok := lang.Func(w.handler, out); ok {
+			_, err = fn([]*lang.Object{e.object()})
+		} else {
+			// stops the watcher, like a failing handler does
+			err = badState.Get("no label or function named " + w.handler)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watcherArg resolves the watcher named by the i-th argument, falling back to
+// the last started watcher
+func watcherArg(args []*lang.Object, i int) (*watcher, error) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	watcherName := lastWatcher
+	if len(args) > i {
+		if args[i].Type != lang.ObjStr {
+			return nil, badType.Get("watcher name must be a string")
+		}
+		watcherName = args[i].StrV
+	} else if watcherName == "" {
+		return nil, badState.Get("could not infer watcher name")
+	}
+	w, ok := watchers[watcherName]
+	if !ok {
+		return nil, badState.Get("no watcher named `" + watcherName + "` exists")
+	}
+	return w, nil
+}
+
+// fWatch starts watching a directory for changes to files matching a
+// pattern, which are handled by a label or function once `watch-wait` runs
+func fWatch(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 3 {
+		return lang.NewNil(), moreArgs.Get("need directory, pattern and handler")
+	}
+	root, pattern, handler := args[0].String(), args[1].String(), args[2].String()
+	if _, isFunc := lang.Func(handler, nil); !isFunc && !lang.HasLabel(handler) {
+		return lang.NewNil(), badArg.Get("no label or function named " + handler)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return lang.NewNil(), badArg.Get("bad pattern " + pattern)
+	}
+	if err := allowRead(root); err != nil {
+		return lang.NewNil(), err
+	}
+	if pattern == "*" {
+		pattern = ""
+	}
+	watchLock.Lock()
+	var watcherName string
+	if len(args) >= 4 {
+		watcherName = args[3].String()
+	} else {
+		watcherName = fmt.Sprintf("watcher%d", watcherCount)
+	}
+	watcherCount++
+	watchLock.Unlock()
+
+	lang.Log.Info("watching files", lang.F("dir", root), lang.F("pattern", pattern), lang.F("watcher", watcherName))
+
+	w := &watcher{
+		root:     root,
+		pattern:  pattern,
+		handler:  handler,
+		interval: defaultWatchInterval * time.Millisecond,
+		debounce: defaultWatchDebounce * time.Millisecond,
+		incoming: make(chan []watchEvent),
+		done:     make(chan struct{}),
+	}
+	// the first scan happens right away, so that anything changed after
+	// watching started is noticed
+	go w.poll(w.scan())
+	watchLock.Lock()
+	watchers[watcherName] = w
+	lastWatcher = watcherName
+	watchLock.Unlock()
+	return lang.NewStr(watcherName), nil
+}
+
+// fWatchWait handles changes until the watcher is stopped, either by one of
+// its handlers or by another task
+func fWatchWait(out io.Writer, args []*lang.Object) (*lang.Object, error) {
+	w, err := watcherArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	ctx := lang.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			w.stop()
+			return lang.NewNil(), ctx.Err()
+		case events := <-w.incoming:
+			if err := w.handle(out, events); err != nil {
+				w.stop()
+				return lang.NewNil(), err
+			}
+		case <-w.done:
+			return lang.NewNil(), nil
+		}
+	}
+}
+
+func fWatchStop(args []*lang.Object) (*lang.Object, error) {
+	w, err := watcherArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	w.stop()
+	return lang.NewNil(), nil
+}
+
+func fWatchInterval(args []*lang.Object) (*lang.Object, error) {
+	ms, err := intArg(args, 0, "interval in milliseconds")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	if ms <= 0 {
+		return lang.NewNil(), badArg.Get("interval must be positive")
+	}
+	w, err := watcherArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	watchLock.Lock()
+	w.interval = time.Duration(ms) * time.Millisecond
+	watchLock.Unlock()
+	return lang.NewNil(), nil
+}
+
+func fWatchDebounce(args []*lang.Object) (*lang.Object, error) {
+	ms, err := intArg(args, 0, "debounce time in milliseconds")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	w, err := watcherArg(args, 1)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	watchLock.Lock()
+	w.debounce = time.Duration(ms) * time.Millisecond
+	watchLock.Unlock()
+	return lang.NewNil(), nil
+}
+
+// stopWatchers stops all watchers, as nothing can handle their changes once
+// the script is done
+func stopWatchers() {
+	watchLock.Lock()
+	running := watchers
+	watchers = make(map[string]*watcher)
+	watchLock.Unlock()
+	for _, w := range running {
+		w.stop()
+	}
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"mohazit/lang"
+)
+
+// WrapStream transforms the data of another stream, in one direction only:
+// either it is read through the wrapper, or written through it. Closing the
+// wrapper finishes the transformed data, but leaves the wrapped stream open.
+type WrapStream struct {
+	// open creates the reader on the first read, since decoders may read
+	// a header right away
+	open   func() (io.Reader, error)
+	reader io.Reader
+	writer io.WriteCloser
+}
+
+func (s *WrapStream) Read(p []byte) (int, error) {
+	if s.open == nil {
+		return 0, badState.Get("stream can only be written to")
+	}
+	if s.reader == nil {
+		r, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		s.reader = r
+	}
+	return s.reader.Read(p)
+}
+
+func (s *WrapStream) Write(p []byte) (int, error) {
+	if s.writer == nil {
+		return 0, badState.Get("stream can only be read from")
+	}
+	return s.writer.Write(p)
+}
+
+func (s *WrapStream) Seek(offset int64, whence int) (int64, error) {
+	return 0, badState.Get("cannot seek in a wrapped stream")
+}
+
+func (s *WrapStream) Close() error {
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+	if c, ok := s.reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// HashStream passes reads and writes through to another stream, hashing all
+// of the data on the way
+type HashStream struct {
+	inner Stream
+	// source is what reads come from, which may have read ahead of inner
+	source io.Reader
+	hash   hash.Hash
+}
+
+func (s *HashStream) Read(p []byte) (int, error) {
+	n, err := s.source.Read(p)
+	s.hash.Write(p[:n])
+	return n, err
+}
+
+func (s *HashStream) Write(p []byte) (int, error) {
+	n, err := s.inner.Write(p)
+	s.hash.Write(p[:n])
+	return n, err
+}
+
+func (s *HashStream) Seek(offset int64, whence int) (int64, error) {
+	return 0, badState.Get("cannot seek in a hashing stream")
+}
+
+func (s *HashStream) Close() error {
+	return nil
+}
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// wrapArg resolves the stream to wrap from the i-th argument and picks the
+// name of the wrapper, either given after it or generated from the prefix
+func wrapArg(args []*lang.Object, i int, prefix string) (string, string, Stream, error) {
+	if len(args) <= i {
+		return "", "", nil, moreArgs.Get("need stream name")
+	}
+	innerName, inner, err := streamArg(args, i)
+	if err != nil {
+		return "", "", nil, err
+	}
+	name := ""
+	if len(args) > i+1 {
+		name = args[i+1].String()
+	} else {
+		name = newStreamName(prefix)
+	}
+	return innerName, name, inner, nil
+}
+
+// wrapWriter registers a stream transforming what is written to it before it
+// goes to the wrapped stream
+func wrapWriter(args []*lang.Object, prefix string, wrap func(io.Writer) io.WriteCloser) (*lang.Object, error) {
+	innerName, name, inner, err := wrapArg(args, 0, prefix)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	unbuffer(innerName, inner)
+
+	lang.Log.Info("wrapping stream", lang.F("stream", name), lang.F("wraps", innerName))
+
+	addStream(name, &WrapStream{writer: wrap(inner)})
+	return lang.NewStr(name), nil
+}
+
+// wrapReader registers a stream transforming what is read from the wrapped
+// stream
+func wrapReader(args []*lang.Object, prefix string, wrap func(io.Reader) (io.Reader, error)) (*lang.Object, error) {
+	innerName, name, inner, err := wrapArg(args, 0, prefix)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	// anything read ahead from the wrapped stream is read first
+	source := bufferedReader(innerName, inner)
+
+	lang.Log.Info("wrapping stream", lang.F("stream", name), lang.F("wraps", innerName))
+
+	addStream(name, &WrapStream{open: func() (io.Reader, error) {
+		return wrap(source)
+	}})
+	return lang.NewStr(name), nil
+}
+
+func fStreamGzip(args []*lang.Object) (*lang.Object, error) {
+	return wrapWriter(args, "gzip", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+}
+
+func fStreamGunzip(args []*lang.Object) (*lang.Object, error) {
+	return wrapReader(args, "gunzip", func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+func fStreamZlib(args []*lang.Object) (*lang.Object, error) {
+	return wrapWriter(args, "zlib", func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	})
+}
+
+func fStreamUnzlib(args []*lang.Object) (*lang.Object, error) {
+	return wrapReader(args, "unzlib", func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	})
+}
+
+func fStreamBase64(args []*lang.Object) (*lang.Object, error) {
+	return wrapWriter(args, "base64", func(w io.Writer) io.WriteCloser {
+		return base64.NewEncoder(base64.StdEncoding, w)
+	})
+}
+
+func fStreamUnbase64(args []*lang.Object) (*lang.Object, error) {
+	return wrapReader(args, "unbase64", func(r io.Reader) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	})
+}
+
+// fStreamHash wraps a stream, hashing everything read from or written to it
+// with the given algorithm
+func fStreamHash(args []*lang.Object) (*lang.Object, error) {
+	algo, err := strArg(args, 0, "hash algorithm")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	newHash, ok := hashes[algo]
+	if !ok {
+		return lang.NewNil(), badArg.Get("unknown hash algorithm " + algo)
+	}
+	innerName, name, inner, err := wrapArg(args, 1, "hash")
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	source := bufferedReader(innerName, inner)
+
+	lang.Log.Info("wrapping stream", lang.F("stream", name), lang.F("wraps", innerName), lang.F("hash", algo))
+
+	addStream(name, &HashStream{inner, source, newHash()})
+	return lang.NewStr(name), nil
+}
+
+func fStreamHashSum(args []*lang.Object) (*lang.Object, error) {
+	if len(args) < 1 {
+		return lang.NewNil(), moreArgs.Get("need stream name")
+	}
+	streamName, stream, err := streamArg(args, 0)
+	if err != nil {
+		return lang.NewNil(), err
+	}
+	h, ok := stream.(*HashStream)
+	if !ok {
+		return lang.NewNil(), badArg.Get("stream " + streamName + " is not hashing")
+	}
+	return lang.NewStr(hex.EncodeToString(h.hash.Sum(nil))), nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"mohazit/lang"
 	"mohazit/lib"
 	"os"
+	"os/signal"
 )
 
 const (
@@ -18,29 +22,70 @@ const (
 )
 
 func main() {
+	sandbox := flag.String("sandbox", "", "only allow what the given policy `file` allows")
+	verbose := flag.Bool("v", false, "show what built-ins are doing")
+	quiet := flag.Bool("q", false, "only show errors")
+	debug := flag.Bool("debug", false, "show everything built-ins are doing")
+	logJSON := flag.Bool("log-json", false, "write log messages as JSON lines")
+	seed := flag.Int64("seed", 0, "seed random numbers with `n`, for reproducible runs")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] script [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	switch {
+	case *debug:
+		lang.Log.SetLevel(lang.LevelDebug)
+	case *verbose:
+		lang.Log.SetLevel(lang.LevelInfo)
+	case *quiet:
+		lang.Log.SetLevel(lang.LevelError)
+	}
+	lang.Log.SetJSON(*logJSON)
 	lib.Load()
-	if len(os.Args) < 2 {
-		fmt.Println("need input file")
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			lib.Seed(*seed)
+		}
+	})
+	if *sandbox != "" {
+		policy, err := lib.LoadPolicy(*sandbox)
+		if err != nil {
+			lang.Log.Error("could not load sandbox policy", lang.F("error", err))
+			exit(eArgs)
+		}
+		lib.Sandbox = policy
+	}
+	if flag.NArg() < 1 {
+		lang.Log.Error("need input file")
 		exit(eArgs)
 	} else {
-		f, err := os.Open(os.Args[1])
+		script := flag.Arg(0)
+		f, err := os.Open(script)
 		if err != nil {
-			fmt.Println(err.Error())
+			lang.Log.Error("could not open script", lang.F("error", err))
 			exit(eFile)
 		}
 		s, err := io.ReadAll(f)
 		if err != nil {
-			fmt.Println(err.Error())
+			lang.Log.Error("could not read script", lang.F("error", err))
 			exit(eRead)
 		}
-		lang.Source(string(s))
-		err = lang.DoAll()
+		lang.SetArgs(script, flag.Args()[1:])
+		// interrupting stops the script, giving it a chance to clean up
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err = lang.RunContext(ctx, string(s))
+		stop()
 		if err != nil {
+			var exitErr *lang.Exit
+			if errors.As(err, &exitErr) {
+				exit(exitErr.Code)
+			}
 			if perr, ok := err.(*lang.ParseError); ok {
-				fmt.Printf("%s:%d:%d [ERROR] %s",
-					os.Args[1], perr.Where.Line, perr.Where.Col, perr.Error())
+				lang.Log.Error(perr.Error(), lang.F("file", script),
+					lang.F("line", perr.Where.Line), lang.F("col", perr.Where.Col))
 			} else {
-				fmt.Println(err.Error())
+				lang.Log.Error(err.Error())
 			}
 			exit(eScript)
 		}
@@ -50,13 +95,13 @@ func main() {
 
 func exit(code int) {
 	if err := lib.Cleanup(); err != nil {
-		fmt.Println("-- CLEANUP ERROR --")
-		fmt.Println("(this usually isn't a serious problem, but should be avoided!")
-		fmt.Println(err.Error())
+		// this usually isn't a serious problem, but should be avoided
+		lang.Log.Warn("cleanup failed", lang.F("error", err))
 		if code == 0 {
 			os.Exit(eCleanup)
 		} else {
 			os.Exit(code)
 		}
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(filepath.Join(dir, "build", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "build", "app.txt"), []byte("app"), 0o644)
+	os.WriteFile(filepath.Join(dir, "build", "sub", "lib.txt"), []byte("library"), 0o644)
+
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		set dir = [list-get] {args} 0
+		cd {dir}
+
+		zip-create out.zip
+		global zip-added = [zip-add] build
+		zip-close
+		set entries = [zip-list] out.zip
+		global zip-entries = [list-len] {entries}
+		global zip-extracted = [zip-extract] out.zip \ unzipped
+		set e = [zip-open-entry] out.zip \ build/sub/lib.txt
+		global zip-entry = [data-read-all] {e}
+		data-close {e}
+
+		set t = [tar-create] out.tar.gz
+		tar-add build \ release \ {t}
+		tar-close {t}
+		set entries = [tar-list] out.tar.gz
+		set first = [list-get] {entries} 0
+		global tar-first = [map-get] {first} \ name
+		tar-extract out.tar.gz \ untarred
+		set e = [tar-open-entry] out.tar.gz \ release/app.txt
+		global tar-entry = [data-read-all] {e}
+		data-close {e}
+	`)
+	if err := lang.DoAll(); err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("zip-added", 4)
+	expectGlobalVariable("zip-entries", 4)
+	expectGlobalVariable("zip-extracted", 4)
+	expectGlobalVariable("zip-entry", "library")
+	expectGlobalVariable("tar-first", "release/")
+	expectGlobalVariable("tar-entry", "app")
+	for _, p := range []string{"unzipped/build/sub/lib.txt", "untarred/release/app.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Fatalf("expected %s to be extracted: %v", p, err)
+		}
+	}
+
+	// entries must not be able to escape the destination
+	f, err := os.Create(filepath.Join(dir, "evil.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("../escaped.txt")
+	w.Write([]byte("gotcha"))
+	zw.Close()
+	f.Close()
+	lang.Source(`
+		zip-extract evil.zip \ safe
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected extracting an escaping entry to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+		t.Fatal("entry was extracted outside of the destination")
+	}
+
+	// nor by going through links extracted before them, where links can be
+	// made without special rights
+	if runtime.GOOS == "windows" {
+		return
+	}
+	f, err = os.Create(filepath.Join(dir, "chain.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0o777})
+	tw.WriteHeader(&tar.Header{Name: "a/l", Typeflag: tar.TypeSymlink, Linkname: "..", Mode: 0o777})
+	tw.WriteHeader(&tar.Header{Name: "a/l/chained.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: 6})
+	tw.Write([]byte("gotcha"))
+	tw.Close()
+	f.Close()
+	lang.Source(`
+		tar-extract chain.tar \ chained
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected extracting through a chain of links to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chained.txt")); err == nil {
+		t.Fatal("entry was extracted outside of the destination through links")
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"testing"
+)
+
+func TestPack(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		set header = [pack] le u32 i16 \ 258 \ -2
+		global header-hex = [hex-encode] {header}
+		set packed = [pack] be u16 s4 str8 f64 \ 65535 \ ab \ hello \ 1.5
+		global size = [bytes-len] {packed}
+		set fields = [unpack] be u16 s4 str8 f64 \ {packed}
+		global count = [list-get] {fields} 0
+		global name = [list-get] {fields} 1
+		global text = [list-get] {fields} 2
+		global num = [list-get] {fields} 3
+		global fixed = [pack-size] le u32 i16 u8
+
+		buf-create bin
+		data-write {header}
+		data-seek 0
+		set raw = [data-read-exact-bytes] 6 \ bin
+		set values = [unpack] le u32 i16 \ {raw}
+		global length = [list-get] {values} 0
+		global signed = [list-get] {values} 1
+		data-close bin
+
+		set decoded = [base64-decode] AP8Q
+		global round-trip = [hex-encode] {decoded}
+		global encoded = [base64-encode] hi
+		set from-hex = [hex-decode] 6869
+		global as-str = [bytes-str] {from-hex}
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("header-hex", "02010000feff")
+	expectGlobalVariable("size", 2+4+1+5+8)
+	expectGlobalVariable("count", 65535)
+	expectGlobalVariable("name", "ab")
+	expectGlobalVariable("text", "hello")
+	expectGlobalVariable("num", 1.5)
+	expectGlobalVariable("fixed", 7)
+	expectGlobalVariable("length", 258)
+	expectGlobalVariable("signed", -2)
+	expectGlobalVariable("round-trip", "00ff10")
+	expectGlobalVariable("encoded", "aGk=")
+	expectGlobalVariable("as-str", "hi")
+
+	for _, src := range []string{
+		"pack u8 \\ 256",
+		"pack i8 \\ 128",
+		"pack u16 u16 \\ 1",
+		"pack u12 \\ 1",
+		"unpack u32 \\ abc",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+}
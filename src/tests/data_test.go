@@ -1,8 +1,13 @@
 package tests
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
 	"mohazit/lang"
 	"mohazit/lib"
+	"strings"
 	"testing"
 )
 
@@ -54,3 +59,152 @@ func TestFile(t *testing.T) {
 
 	expectGlobalVariable("res", "ello")
 }
+
+func TestDataReadLine(t *testing.T) {
+	gt = t
+	lib.Load()
+	lang.Source(`
+		buf-create lines
+		buf-create other
+		data-write one\ntwo;;three \ lines
+		data-seek 0 \ lines
+		global short = [data-read] 100 \ lines
+		data-seek 0 \ lines
+		global line = [data-read-line] lines
+		data-write unrelated \ other
+		global until = [data-read-until] ;; \ lines
+		global not-eof = [data-eof?] lines
+		global rest = [data-read-all] lines
+		global eof = [data-eof?] lines
+		global past-end = [data-read-line] lines
+		data-seek 0 \ lines
+		global exact = [data-read-exact] 3 \ lines
+		set skipped = [data-read-line] lines
+		data-write TWO \ lines
+		data-seek 0 \ lines
+		global written = [data-read-all] lines
+		data-close lines
+		data-close other
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Fatalf("%s @%s", perr.Error(), perr.Where)
+		} else {
+			t.Fatal(err.Error())
+		}
+	}
+
+	expectGlobalVariable("short", "one\ntwo;;three")
+	expectGlobalVariable("line", "one")
+	expectGlobalVariable("until", "two")
+	expectGlobalVariable("not-eof", false)
+	expectGlobalVariable("rest", "three")
+	expectGlobalVariable("eof", true)
+	expectGlobalVariable("past-end", nil)
+	expectGlobalVariable("exact", "one")
+	expectGlobalVariable("written", "one\nTWO;;three")
+
+	// reads larger than the read buffer still get everything asked for
+	lang.SetArgs("test.mhzt", []string{strings.Repeat("x", 6000)})
+	lang.Source(`
+		buf-create large
+		set big = [list-get] {args} 0
+		data-write {big} \ large
+		data-seek 0 \ large
+		set got = [data-read] 6000 \ large
+		global large-len = [str-len] {got}
+		data-close large
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("large-len", 6000)
+
+	lang.Source(`
+		buf-create short
+		data-write abc
+		data-seek 0
+		data-read-exact 10 \ short
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error reading past the end")
+	}
+}
+
+func TestStreamWrap(t *testing.T) {
+	gt = t
+	lib.Load()
+	lang.Source(`
+		buf-create plain
+		data-write hello hello hello hello \ plain
+		data-seek 0 \ plain
+		buf-create packed
+		set gz = [stream-gzip] packed
+		data-copy plain \ {gz}
+		data-close {gz}
+		data-seek 0 \ packed
+		set gunzip = [stream-gunzip] packed
+		global unpacked = [data-read-all] {gunzip}
+		data-close {gunzip}
+
+		data-seek 0 \ plain
+		buf-create z
+		stream-zlib z \ zlib-out
+		data-copy plain \ zlib-out
+		data-close zlib-out
+		data-seek 0 \ z
+		stream-unzlib z \ zlib-in
+		global unzlibbed = [data-read-line] zlib-in
+		data-close zlib-in
+
+		buf-create b64
+		stream-base64 b64 \ b64-out
+		data-write hi \ b64-out
+		data-close b64-out
+		data-seek 0 \ b64
+		global encoded = [data-read-all] b64
+		data-seek 0 \ b64
+		stream-unbase64 b64 \ b64-in
+		global decoded = [data-read-all] b64-in
+		data-close b64-in
+
+		data-seek 0 \ plain
+		buf-create copy
+		stream-hash sha256 \ copy \ hashed
+		data-copy plain \ hashed
+		global sum = [stream-hash-sum] hashed
+		data-close hashed
+		data-seek 0 \ plain
+		stream-hash crc32 \ plain \ crc
+		set ignored = [data-read-all] crc
+		global crc = [stream-hash-sum] crc
+		data-close crc
+
+		data-close plain
+		data-close packed
+		data-close z
+		data-close b64
+		data-close copy
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Fatalf("%s @%s", perr.Error(), perr.Where)
+		} else {
+			t.Fatal(err.Error())
+		}
+	}
+
+	expectGlobalVariable("unpacked", "hello hello hello hello")
+	expectGlobalVariable("unzlibbed", "hello hello hello hello")
+	expectGlobalVariable("encoded", "aGk=")
+	expectGlobalVariable("decoded", "hi")
+	expectGlobalVariable("sum", sha256Hex("hello hello hello hello"))
+	expectGlobalVariable("crc", fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("hello hello hello hello"))))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,314 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFilesystem(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		set dir = [list-get] {args} 0
+		cd {dir}
+		mkdir src/nested
+		file-create src/a.txt
+		set f = [file-open] src/a.txt
+		data-write hello
+		data-close
+		file-create src/nested/b.txt
+		chmod src/a.txt \ 600
+		set info = [file-stat] src/a.txt
+		global size = [map-get] {info} \ size
+		global perm = [map-get] {info} \ perm
+		global is-dir = [map-get] {info} \ dir
+
+		file-copy src \ copy
+		global copied = [file-exists] copy/nested/b.txt
+		set copied-info = [file-stat] copy/a.txt
+		global copied-perm = [map-get] {copied-info} \ perm
+		file-move copy \ moved
+		global moved = [file-exists] moved/a.txt
+
+		set found = [glob] src/*.txt
+		global found = [list-len] {found}
+		set entries = [file-list] src
+		global listed = [list-len] {entries}
+		set first = [list-get] {entries} 0
+		global first = [map-get] {first} \ name
+
+		dir-remove moved
+		global removed = [file-exists] moved
+	`)
+	if err := lang.DoAll(); err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("size", 5)
+	expectGlobalVariable("perm", "0600")
+	expectGlobalVariable("is-dir", false)
+	expectGlobalVariable("copied", true)
+	expectGlobalVariable("copied-perm", "0600")
+	expectGlobalVariable("moved", true)
+	expectGlobalVariable("found", 1)
+	expectGlobalVariable("listed", 2)
+	expectGlobalVariable("first", "a.txt")
+	expectGlobalVariable("removed", false)
+	if _, err := os.Stat(filepath.Join(dir, "src", "nested")); err != nil {
+		t.Fatal(err)
+	}
+
+	// making links needs special rights on windows
+	if runtime.GOOS != "windows" {
+		lang.Source(`
+			file-symlink a.txt \ src/link.txt
+			set link-info = [file-stat] src/link.txt
+			global is-link = [map-get] {link-info} \ link
+			set found = [glob] src/*.txt
+			global found = [list-len] {found}
+		`)
+		if err := lang.DoAll(); err != nil {
+			t.Fatal(err.Error())
+		}
+		expectGlobalVariable("is-link", true)
+		expectGlobalVariable("found", 2)
+	}
+
+	// a directory can't be copied into itself
+	lang.Source(`
+		file-copy src \ src/nested/again
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected copying a directory into itself to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "nested", "again")); err == nil {
+		t.Fatal("directory was copied into itself")
+	}
+}
+
+func TestFileWhole(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		set dir = [list-get] {args} 0
+		cd {dir}
+		file-write config.txt \ alpha\n
+		file-append config.txt \ beta\r\n
+		global whole = [file-read] config.txt
+		set lines = [file-lines] config.txt
+		global line-count = [list-len] {lines}
+		global second = [list-get] {lines} 1
+
+		chmod config.txt \ 600
+		file-write-atomic config.txt \ replaced
+		global replaced = [file-read] config.txt
+		set info = [file-stat] config.txt
+		global perm = [map-get] {info} \ perm
+		set entries = [file-list] .
+		global entries = [list-len] {entries}
+
+		set f = [file-open] log.txt \ append
+		data-write one
+		data-close
+		set f = [file-open] log.txt \ append
+		data-write two
+		data-close
+		set f = [file-open] log.txt \ read
+		global appended = [data-read-all]
+		data-close
+	`)
+	if err := lang.DoAll(); err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("whole", "alpha\nbeta\r\n")
+	expectGlobalVariable("line-count", 2)
+	expectGlobalVariable("second", "beta")
+	expectGlobalVariable("replaced", "replaced")
+	expectGlobalVariable("perm", "0600")
+	expectGlobalVariable("entries", 1)
+	expectGlobalVariable("appended", "onetwo")
+
+	for _, src := range []string{
+		"file-open log.txt \\ exclusive",
+		"file-open log.txt \\ sideways",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		global joined = [path-join] src \ lib \ data.go
+		global base = [path-base] {joined}
+		global ext = [path-ext] {joined}
+		global parent = [path-dir] {joined}
+		global clean = [path-clean] src/./lib/../main.go
+		global rel = [path-rel] src \ src/lib/data.go
+		set parts = [path-split] {joined}
+		global split-file = [list-get] {parts} 1
+
+		set dir = [list-get] {args} 0
+		cd {dir}
+		global pushed = [pushd] a \ b
+		global popped = [popd]
+	`)
+	if err := lang.DoAll(); err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGlobalVariable("joined", filepath.Join("src", "lib", "data.go"))
+	expectGlobalVariable("base", "data.go")
+	expectGlobalVariable("ext", ".go")
+	expectGlobalVariable("parent", filepath.Join("src", "lib"))
+	expectGlobalVariable("clean", filepath.Join("src", "main.go"))
+	expectGlobalVariable("rel", filepath.Join("lib", "data.go"))
+	expectGlobalVariable("split-file", "data.go")
+	expectGlobalVariable("pushed", filepath.Join(real, "a", "b"))
+	expectGlobalVariable("popped", real)
+
+	lang.Source("popd")
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected popd on an empty stack to fail")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		label changed
+			set kind = [map-get] {event} \ type
+			set path = [map-get] {event} \ path
+			set base = [path-base] {path}
+			global seen = [list-append] {seen} \ {kind} \ {base}
+			if {kind} = delete
+				watch-stop
+			end
+		end
+		global seen = [list]
+		set dir = [list-get] {args} 0
+		watch {dir} \ *.txt \ changed
+		watch-interval 20
+		watch-debounce 200
+		set ready = [path-join] {dir} \ ready
+		file-create {ready}
+		watch-wait
+		global events = [str-join] {seen} \ ,
+	`)
+	done := make(chan error)
+	go func() {
+		done <- lang.DoAll()
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "ready")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// writing a file in several steps is still a single change
+	file := filepath.Join(dir, "a.txt")
+	os.WriteFile(file, []byte("one"), 0o644)
+	time.Sleep(30 * time.Millisecond)
+	os.WriteFile(file, []byte("one two"), 0o644)
+	os.WriteFile(filepath.Join(dir, "ignored.log"), []byte("log"), 0o644)
+	time.Sleep(500 * time.Millisecond)
+	os.Remove(file)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+	expectGlobalVariable("events", "create,a.txt,delete,a.txt")
+
+	// a handler that went missing stops the watcher, here once a file matching
+	// a pattern with a directory in it shows up
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	lang.Funcs["vanishing"] = func(args []*lang.Object) (*lang.Object, error) {
+		return lang.NewNil(), nil
+	}
+	lang.Source(`
+		set dir = [list-get] {args} 0
+		watch {dir} \ sub/*.txt \ vanishing
+		watch-interval 20
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	delete(lang.Funcs, "vanishing")
+	lang.Source(`
+		watch-wait
+	`)
+	go func() {
+		done <- lang.DoAll()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0o644)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected a missing handler to stop the watcher with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+	lib.Cleanup()
+}
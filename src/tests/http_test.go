@@ -0,0 +1,429 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"mohazit/lang"
+	"mohazit/lib"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Query", r.URL.Query().Get("q"))
+		w.Header().Set("X-Token", r.Header.Get("Authorization"))
+		user, pass, _ := r.BasicAuth()
+		w.Header().Set("X-User", user+":"+pass)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/echo", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHttp(t *testing.T) {
+	srv := testServer()
+	defer srv.Close()
+	lib.Load()
+	gt = t
+	lang.SetArgs("test.mhzt", []string{srv.URL})
+	lang.Source(`
+		set base = [list-get] {args} 0
+		set url = [format] %s/echo \ {base}
+		set resp = [http-post] {url} \ hello
+		global body = [data-read] 5
+		data-close
+		global method = [http-response-header] X-Method
+		global ok = [http-ok] {resp}
+
+		set req = [http-request] PATCH \ {url}
+		http-header X-Extra \ 1
+		http-query q \ search term
+		http-auth-bearer secret
+		http-body patched
+		set resp = [http-send]
+		data-close
+		global patched = [http-response-header] X-Method \ {resp}
+		global query = [http-response-header] X-Query
+		global token = [http-response-header] X-Token
+		set cookies = [http-cookies]
+		global cookie = [map-get] {cookies} \ session
+
+		set req = [http-request] GET \ {url}
+		http-auth-basic user \ pass
+		http-send
+		data-close
+		global user = [http-response-header] X-User
+
+		set url = [format] %s/missing \ {base}
+		http-get {url}
+		data-close
+		global status = [http-status]
+		global status-text = [http-status-text]
+		global not-ok = [http-ok]
+
+		set url = [format] %s/redirect \ {base}
+		set req = [http-request] GET \ {url}
+		http-redirects 0
+		http-send
+		data-close
+		global redirect = [http-status]
+		set headers = [http-response-headers]
+		global location = [map-get] {headers} \ Location
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("body", "hello")
+	expectGlobalVariable("method", "POST")
+	expectGlobalVariable("ok", true)
+	expectGlobalVariable("patched", "PATCH")
+	expectGlobalVariable("query", "search term")
+	expectGlobalVariable("token", "Bearer secret")
+	expectGlobalVariable("cookie", "abc")
+	expectGlobalVariable("user", "user:pass")
+	expectGlobalVariable("status", 404)
+	expectGlobalVariable("status-text", "Not Found")
+	expectGlobalVariable("not-ok", false)
+	expectGlobalVariable("redirect", 302)
+	expectGlobalVariable("location", "/echo")
+
+	// sent requests and closed responses are forgotten, except for the last
+	// response
+	for _, src := range []string{
+		"http-send {req}",
+		"http-status {resp}",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+
+	lang.Source(`
+		set url = [format] %s/slow \ {base}
+		set req = [http-request] GET \ {url}
+		http-timeout 50
+		http-send
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+}
+
+// freeAddr finds a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServe(t *testing.T) {
+	addr := freeAddr(t)
+	lib.Load()
+	gt = t
+	lang.SetArgs("test.mhzt", []string{addr})
+	lang.Source(`
+		label hello
+			set query = [map-get] {request} \ query
+			set who = [map-get] {query} \ name
+			http-respond-header X-Greeting \ hi
+			set msg = [format] hello %s \ {who}
+			http-respond {msg}
+		end
+		label create
+			http-respond-status 201
+			set body = [map-get] {request} \ body
+			http-respond {body}
+		end
+		label fail
+			unknown-function
+		end
+		label stop
+			http-stop
+		end
+		route GET \ /hello \ hello
+		route POST \ /items \ create
+		route ANY \ /fail \ fail
+		route ANY \ /stop \ stop
+		route GET \ /json \ json-stringify
+		set addr = [list-get] {args} 0
+		http-listen {addr}
+		http-wait
+		global done = true
+	`)
+	done := make(chan error)
+	go func() {
+		done <- lang.DoAll()
+	}()
+
+	base := "http://" + addr
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get(base + "/hello?name=bob")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello bob" || resp.Header.Get("X-Greeting") != "hi" {
+		t.Fatalf("wrong response, got %q", body)
+	}
+
+	resp, err = http.Post(base+"/items", "text/plain", strings.NewReader("thing"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "thing" {
+		t.Fatalf("wrong response, got %d %q", resp.StatusCode, body)
+	}
+
+	expectStatus := func(method, path string, want int) {
+		req, _ := http.NewRequest(method, base+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: got status %d, want %d", method, path, resp.StatusCode, want)
+		}
+	}
+	resp, err = http.Get(base + "/json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"method":"GET"`) {
+		t.Fatalf("wrong response from function handler, got %q", body)
+	}
+
+	expectStatus(http.MethodGet, "/nowhere", http.StatusNotFound)
+	expectStatus(http.MethodDelete, "/hello", http.StatusMethodNotAllowed)
+	// a failing handler only fails its own request
+	expectStatus(http.MethodGet, "/fail", http.StatusInternalServerError)
+	expectStatus(http.MethodGet, "/hello", http.StatusOK)
+
+	// a body right at the limit is still fine
+	resp, err = http.Post(base+"/items", "text/plain", strings.NewReader(strings.Repeat("x", 10<<20)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || len(body) != 10<<20 {
+		t.Fatalf("wrong response for a body at the limit, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	resp, err = http.Post(base+"/items", "text/plain", strings.NewReader(strings.Repeat("x", 10<<20+1)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("wrong status for a large body, got %d", resp.StatusCode)
+	}
+	expectStatus(http.MethodGet, "/stop", http.StatusOK)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	expectGlobalVariable("done", true)
+
+	// exiting from a handler still ends the script
+	addr = freeAddr(t)
+	lang.SetArgs("test.mhzt", []string{addr})
+	lang.Source(`
+		label quit
+			exit 4
+		end
+		route ANY \ /quit \ quit
+		set addr = [list-get] {args} 0
+		http-serve {addr}
+	`)
+	go func() {
+		done <- lang.DoAll()
+	}()
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get("http://" + addr + "/fail")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("wrong status, got %d", resp.StatusCode)
+	}
+	base = "http://" + addr
+	expectStatus(http.MethodGet, "/quit", http.StatusInternalServerError)
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*lang.Exit); !ok || exitErr.Code != 4 {
+			t.Fatalf("expected exit 4, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	lib.Cleanup()
+}
+
+func TestServeMissingHandler(t *testing.T) {
+	addr := freeAddr(t)
+	lib.Load()
+	gt = t
+	// servers from before loading are forgotten
+	lang.Source(`
+		http-wait
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error waiting without a server")
+	}
+
+	lang.Funcs["vanishing"] = func(args []*lang.Object) (*lang.Object, error) {
+		return lang.NewNil(), nil
+	}
+	lang.Source(`
+		route ANY \ /gone \ vanishing
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	delete(lang.Funcs, "vanishing")
+
+	lang.SetArgs("test.mhzt", []string{addr})
+	lang.Source(`
+		label stop
+			http-stop
+		end
+		route ANY \ /stop \ stop
+		set addr = [list-get] {args} 0
+		http-serve {addr}
+	`)
+	done := make(chan error)
+	go func() {
+		done <- lang.DoAll()
+	}()
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get("http://" + addr + "/gone")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("wrong status for a missing handler, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + addr + "/stop")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+type fakeTransport func(*http.Request) (*http.Response, error)
+
+func (f fakeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// brokenReader fails if the body is read past the first chunk, which would
+// mean the whole body was loaded at once
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("body was read too far")
+}
+
+func TestHttpTransport(t *testing.T) {
+	lib.HTTPTransport = fakeTransport(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Header:     http.Header{"X-Url": []string{r.URL.String()}},
+			Body: io.NopCloser(io.MultiReader(
+				strings.NewReader("first chunk|"),
+				brokenReader{})),
+			Request: r,
+		}, nil
+	})
+	defer func() { lib.HTTPTransport = nil }()
+	lib.Load()
+	gt = t
+	lang.Source(`
+		set req = [http-request] GET \ http://example.invalid/stream
+		http-query page \ 2
+		http-send
+		data-seek 6
+		global chunk = [data-read] 5
+		data-close
+		global url = [http-response-header] X-Url
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("chunk", "chunk")
+	expectGlobalVariable("url", "http://example.invalid/stream?page=2")
+}
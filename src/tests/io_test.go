@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"bytes"
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	lib.Load()
+	gt = t
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	lang.Stdout = out
+	lang.Stderr = errOut
+	defer func() {
+		lang.Stdout = os.Stdout
+		lang.Stderr = os.Stderr
+	}()
+	lang.Source(`
+		say hello
+		capture greeting
+			say captured
+			capture inner
+				say nested
+			end
+			say {inner}
+		end
+		buf-create captured-stream
+		capture-stream captured-stream
+			say into a stream
+		end
+		data-seek 0 \ captured-stream
+		global from-stream = [data-read] 6
+		data-close captured-stream
+		say world
+		log-level info
+		buf-create logged
+		data-close logged
+		log-level warn
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	if out.String() != "hello \nworld \n" {
+		t.Fatalf("wrong output, got %q", out.String())
+	}
+	if !bytes.Contains(errOut.Bytes(), []byte("INFO opening buffer stream=logged")) {
+		t.Fatalf("log messages did not go to stderr, got %q", errOut.String())
+	}
+	expectGlobalVariable("greeting", "captured \nnested \n \n")
+	expectGlobalVariable("from-stream", "into a")
+}
+
+func TestCaptureTasks(t *testing.T) {
+	lib.Load()
+	gt = t
+	out := &bytes.Buffer{}
+	lang.Stdout = out
+	defer func() { lang.Stdout = os.Stdout }()
+	// the task is still capturing when the script says something
+	lang.Source(`
+		global entered = false
+		label capturer
+			capture mine
+				say mine
+				global entered = true
+				lock go-on
+				unlock go-on
+			end
+			global captured-by-task = {mine}
+		end
+		lock go-on
+		set task = [spawn] capturer
+		repeat
+			sleep 1
+		while {entered} = false
+		say theirs
+		unlock go-on
+		wait {task}
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != "theirs \n" {
+		t.Fatalf("wrong output, got %q", out.String())
+	}
+	expectGlobalVariable("captured-by-task", "mine \n")
+
+	// tasks spawned inside a capture write into it, until the capture is over
+	out.Reset()
+	lang.Source(`
+		label late-sayer
+			lock late
+			say late
+			unlock late
+		end
+		lock late
+		capture both
+			say before
+			set task = [spawn] say \ from-task
+			wait {task}
+			set task = [spawn] late-sayer
+		end
+		global captured-with-task = {both}
+		unlock late
+		wait {task}
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("captured-with-task", "before \nfrom-task \n")
+	if out.String() != "late \n" {
+		t.Fatalf("wrong output after the capture, got %q", out.String())
+	}
+}
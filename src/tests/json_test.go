@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"testing"
+)
+
+func TestJson(t *testing.T) {
+	lib.Load()
+	gt = t
+	err := os.WriteFile("test.json", []byte(`{
+		"name": "mohazit",
+		"version": 16,
+		"ratio": 0.5,
+		"tags": ["dead", "simple"],
+		"deps": [{"name": "grequests", "archived": true}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove("test.json")
+	lang.Source(`
+		set f = [file-open] test.json
+		global doc = [json-read]
+		data-close
+		global name = [json-path] {doc} \ name
+		global version = [json-path] {doc} \ version
+		global ratio = [json-path] {doc} \ ratio
+		global tag = [json-path] {doc} \ tags.1
+		global archived = [json-path] {doc} \ deps.0.archived
+		global missing = [json-path] {doc} \ deps.5.name
+		set m = [map] a \ 1 \ b \ hello
+		global text = [json-stringify] {m}
+		global back = [json-parse] {text}
+		global equal = [json-stringify json-parse] {doc}
+	`)
+	err = lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("name", "mohazit")
+	expectGlobalVariable("version", 16)
+	expectGlobalVariable("ratio", 0.5)
+	expectGlobalVariable("tag", "simple")
+	expectGlobalVariable("archived", true)
+	expectGlobalVariable("missing", nil)
+	expectGlobalVariable("text", `{"a":1,"b":"hello"}`)
+	back, _ := lang.GetGlobalVar("back")
+	m, _ := lang.GetGlobalVar("m")
+	if !back.Equals(m) {
+		t.Fatalf("round trip changed the map: %s", back.Repr())
+	}
+	doc, _ := lang.GetGlobalVar("doc")
+	equal, _ := lang.GetGlobalVar("equal")
+	if !doc.Equals(equal) {
+		t.Fatalf("round trip changed the document: %s", equal.Repr())
+	}
+}
+
+func TestJsonStream(t *testing.T) {
+	lib.Load()
+	gt = t
+	err := os.WriteFile("stream.json", []byte("header\n{\"a\":1}[2]42 \"x\"\ntrailer\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove("stream.json")
+	// values are read one at a time, along with the lines around them
+	lang.Source(`
+		set f = [file-open] stream.json
+		global header = [data-read-line]
+		set obj = [json-read]
+		global a = [map-get] {obj} \ a
+		set list = [json-read]
+		global two = [list-get] {list} 0
+		global num = [json-read]
+		global str = [json-read]
+		global rest = [data-read-line]
+		global trailer = [data-read-line]
+		data-close
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("header", "header")
+	expectGlobalVariable("a", 1)
+	expectGlobalVariable("two", 2)
+	expectGlobalVariable("num", 42)
+	expectGlobalVariable("str", "x")
+	expectGlobalVariable("rest", "")
+	expectGlobalVariable("trailer", "trailer")
+}
+
+func TestJsonTrailing(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.SetArgs("test.mhzt", []string{"{\"a\":1} \n", "{\"a\":1} garbage", "[1][2]"})
+	lang.Source(`
+		set padded = [list-get] {args} 0
+		set parsed = [json-parse] {padded}
+		global a = [map-get] {parsed} \ a
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("a", 1)
+	for _, i := range []string{"1", "2"} {
+		lang.Source("set bad = [list-get] {args} " + i + "\njson-parse {bad}\n")
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected argument %s to be rejected", i)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func expectLimit(t *testing.T, err error, kind lang.LimitKind) {
+	var limitErr *lang.LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a %s limit error, got %v", kind, err)
+	}
+	if limitErr.Kind != kind {
+		t.Fatalf("wrong limit exceeded, got %s, want %s", limitErr.Kind, kind)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	lib.Load()
+	gt = t
+	defer lang.Finish()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := lang.RunContext(ctx, `
+		loop
+		while true = true
+	`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to stop the script, got %v", err)
+	}
+
+	addr := freeAddr(t)
+	lang.SetArgs("test.mhzt", []string{addr})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err = lang.RunContext(ctx, `
+		set addr = [list-get] {args} 0
+		sock-listen {addr} \ blocked
+		sock-accept blocked
+	`)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelling to stop the script, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("accepting a connection was not interrupted")
+	}
+
+	// reading from a connection opened by the script
+	addr = freeAddr(t)
+	lang.SetArgs("test.mhzt", []string{addr})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	err = lang.RunContext(ctx, `
+		set addr = [list-get] {args} 0
+		sock-listen {addr} \ silent
+		set conn = [sock-dial] {addr}
+		data-read 1 \ {conn}
+	`)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelling to stop the script, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("reading from a connection was not interrupted")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	lib.Load()
+	gt = t
+	defer func() { lang.Limit = lang.Limits{} }()
+	defer lang.Finish()
+
+	lang.Limit = lang.Limits{Statements: 20}
+	err := lang.RunContext(context.Background(), `
+		set i = 0
+		repeat
+			set i = [inc] {i}
+		while {i} < 100
+	`)
+	expectLimit(t, err, lang.LimitStatements)
+
+	lang.Limit = lang.Limits{CallDepth: 5}
+	err = lang.RunContext(context.Background(), `
+		label forever
+			goto forever
+		end
+		goto forever
+	`)
+	expectLimit(t, err, lang.LimitCallDepth)
+
+	lang.Limit = lang.Limits{WallTime: 50 * time.Millisecond}
+	err = lang.RunContext(context.Background(), `
+		loop
+		while true = true
+	`)
+	expectLimit(t, err, lang.LimitWallTime)
+
+	lang.Limit = lang.Limits{BufferBytes: 100}
+	lang.SetArgs("test.mhzt", []string{strings.Repeat("x", 200)})
+	err = lang.RunContext(context.Background(), `
+		buf-create limited
+		data-write hello \ limited
+		set big = [list-get] {args} 0
+		data-write {big} \ limited
+	`)
+	expectLimit(t, err, lang.LimitBufferBytes)
+
+	// whole files and captured output count as well
+	big := filepath.Join(t.TempDir(), "big.txt")
+	if err := os.WriteFile(big, []byte(strings.Repeat("x", 200)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	lang.SetArgs("test.mhzt", []string{big})
+	err = lang.RunContext(context.Background(), `
+		set path = [list-get] {args} 0
+		set text = [file-read] {path}
+	`)
+	expectLimit(t, err, lang.LimitBufferBytes)
+	lang.SetArgs("test.mhzt", []string{strings.Repeat("x", 200)})
+	err = lang.RunContext(context.Background(), `
+		capture out
+			say [list-get] {args} 0
+		end
+	`)
+	expectLimit(t, err, lang.LimitBufferBytes)
+
+	err = lang.RunContext(context.Background(), `
+		set long = [str-repeat] x \ 1000
+	`)
+	expectLimit(t, err, lang.LimitBufferBytes)
+
+	// asking for more than there is only holds what is there
+	lang.Limit = lang.Limits{BufferBytes: 200}
+	err = lang.RunContext(context.Background(), `
+		buf-create small
+		data-write hello \ small
+		data-seek 0 \ small
+		global got-small = [data-read] 1000000000 \ small
+		data-seek 0 \ small
+		data-read-exact 1000000000 \ small
+	`)
+	if err == nil || !strings.Contains(err.Error(), "ended after 5 of 1000000000 bytes") {
+		t.Fatalf("expected the stream to end early, got %v", err)
+	}
+	expectGlobalVariable("got-small", "hello")
+	lang.Limit = lang.Limits{}
+	if err := lang.RunContext(context.Background(), "data-close small"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := lang.RunContext(context.Background(), "data-close limited"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestLimitsTasks(t *testing.T) {
+	lib.Load()
+	gt = t
+	defer func() { lang.Limit = lang.Limits{} }()
+
+	// the task outlives the script, but not its wall time
+	lang.Limit = lang.Limits{WallTime: 100 * time.Millisecond}
+	err := lang.RunContext(context.Background(), `
+		label spin
+			loop
+			while true = true
+		end
+		spawn spin
+	`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() { done <- lib.Cleanup() }()
+	select {
+	case err = <-done:
+		expectLimit(t, err, lang.LimitWallTime)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task was not stopped by the wall time limit")
+	}
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"mohazit/lang"
+	"mohazit/lib"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	lib.Load()
+	gt = t
+	out := &bytes.Buffer{}
+	lang.Log.SetOutput(out)
+	defer func() {
+		lang.Log.SetOutput(nil)
+		lang.Log.SetLevel(lang.LevelWarn)
+		lang.Log.SetJSON(false)
+	}()
+
+	lang.Log.SetLevel(lang.LevelWarn)
+	lang.Source(`
+		buf-create quiet
+		data-close quiet
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected no output by default, got %q", out.String())
+	}
+
+	lang.Source(`
+		global before = [log-level]
+		log-level debug
+		buf-create loud
+		data-write hello \ loud
+		data-close loud
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("before", "warn")
+	if !strings.Contains(out.String(), "INFO opening buffer stream=loud\n") ||
+		!strings.Contains(out.String(), "DEBUG writing stream=loud bytes=5\n") {
+		t.Fatalf("wrong text output, got %q", out.String())
+	}
+
+	out.Reset()
+	lang.Log.SetJSON(true)
+	lang.Source(`
+		buf-create structured
+		data-write hi \ structured
+		data-close structured
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong amount of lines, got %q", out.String())
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err.Error())
+	}
+	if entry["level"] != "debug" || entry["msg"] != "writing" ||
+		entry["stream"] != "structured" || entry["bytes"] != float64(2) {
+		t.Fatalf("wrong JSON entry, got %v", entry)
+	}
+
+	lang.Source("log-level loudest")
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an unknown log level to fail")
+	}
+}
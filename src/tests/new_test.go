@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"bytes"
 	"mohazit/lang"
 	"mohazit/lib"
+	"strings"
 
 	"testing"
 )
@@ -149,6 +151,28 @@ func TestIf(t *testing.T) {
 	expectGlobalVariable("b-ok", true)
 	expectGlobalVariable("c-ok", true)
 	expectGlobalVariable("d-ok", true)
+
+	// lists and maps can't be converted to, so comparing fails instead of
+	// crashing
+	for _, src := range []string{
+		"set l = [list] x \\ y\nif {l} ~= foo\nend",
+		"set m = [map] k \\ v\nif {m} ~= foo\nend",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+	lang.Source(`
+		set l = [list] x \ y
+		unless foo ~= {l}
+			global like-ok = true
+		end
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("like-ok", true)
 }
 
 func TestVar(t *testing.T) {
@@ -289,3 +313,129 @@ func TestLoop(t *testing.T) {
 	expectGlobalVariable("abc", false)
 	expectGlobalVariable("i", 10)
 }
+
+func TestArgs(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.SetArgs("test.mhzt", []string{"--name", "bob", "--count=5", "--loud", "extra"})
+	lang.Source(`
+		param --name \ world \ who to greet
+		param --count \ 1
+		param --loud \ false
+		param --other \ default
+		global first = [list-get] {args} 0
+		env-set MHZT_TEST_VAR \ hello
+		global env = [env-get] MHZT_TEST_VAR
+		env-unset MHZT_TEST_VAR
+		global unset = [env-get] MHZT_TEST_VAR \ gone
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("name", "bob")
+	expectGlobalVariable("count", 5)
+	expectGlobalVariable("loud", true)
+	expectGlobalVariable("other", "default")
+	expectGlobalVariable("arg-count", 5)
+	expectGlobalVariable("first", "--name")
+	expectGlobalVariable("env", "hello")
+	expectGlobalVariable("unset", "gone")
+}
+
+func TestHelp(t *testing.T) {
+	lib.Load()
+	gt = t
+	var out bytes.Buffer
+	prev := lang.Stdout
+	lang.Stdout = &out
+	defer func() {
+		lang.Stdout = prev
+	}()
+	// scripts without parameters are not run either
+	lang.SetArgs("test.mhzt", []string{"--help"})
+	lang.Source(`
+		global helped = true
+	`)
+	err := lang.DoAll()
+	exitErr, ok := err.(*lang.Exit)
+	if !ok || exitErr.Code != 0 {
+		t.Fatalf("expected exit 0, got %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "usage: test.mhzt") {
+		t.Fatalf("expected usage, got %q", out.String())
+	}
+	if _, ok := lang.GetGlobalVar("helped"); ok {
+		t.Fatal("script was run despite --help")
+	}
+}
+
+func TestExit(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.SetArgs("test.mhzt", []string{})
+	lang.Source(`
+		global before = true
+		exit 3
+		global after = true
+	`)
+	err := lang.DoAll()
+	exitErr, ok := err.(*lang.Exit)
+	if !ok {
+		t.Fatalf("expected exit, got %v", err)
+	}
+	if exitErr.Code != 3 {
+		t.Fatalf("wrong exit code, got %d, want 3", exitErr.Code)
+	}
+	expectGlobalVariable("before", true)
+	if _, ok := lang.GetGlobalVar("after"); ok {
+		t.Fatal("statement after exit was run")
+	}
+}
+
+func TestNested(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		label count
+
+			set i = 0
+			set evens = 0
+			repeat
+				if {i} = 4
+
+					global four = true
+				else
+					unless {i} > 4
+						set evens = [inc] {evens}
+					end
+				end
+				set i = [inc] {i}
+			while {i} < 6
+			global evens = {evens}
+		end
+		goto count
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("four", true)
+	expectGlobalVariable("evens", 4)
+
+	lang.Source(`
+		if 1 = 1
+			say never closed
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error for an unclosed block")
+	}
+}
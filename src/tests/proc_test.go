@@ -0,0 +1,272 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helperName is the program the process tests run, which is a copy of the
+// test binary, so that they don't depend on the tools of any one system
+const helperName = "mhzt-helper"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("MHZT_TEST_HELPER") == "1" {
+		os.Exit(helper(os.Args[1:]))
+	}
+	dir, err := installHelper()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not install the helper program:", err)
+		os.Exit(1)
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("MHZT_TEST_HELPER", "1")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// installHelper copies the test binary into a directory of its own, which is
+// put on PATH
+func installHelper() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "mhzt-helper")
+	if err != nil {
+		return "", err
+	}
+	name := helperName
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	src, err := os.Open(self)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return dir, dst.Close()
+}
+
+// helper stands in for the usual command line tools, returning the exit code
+func helper(args []string) int {
+	if len(args) == 0 {
+		return 2
+	}
+	switch args[0] {
+	case "print":
+		// print TEXT CODE
+		fmt.Print(args[1])
+		code, _ := strconv.Atoi(args[2])
+		return code
+	case "join":
+		fmt.Println(strings.Join(args[1:], "-"))
+	case "cat":
+		io.Copy(os.Stdout, os.Stdin)
+	case "env":
+		fmt.Print(os.Getenv(args[1]))
+	case "pwd":
+		wd, _ := os.Getwd()
+		fmt.Println(wd)
+	case "sleep":
+		time.Sleep(5 * time.Second)
+	case "lines":
+		for _, line := range args[1:] {
+			fmt.Println(line)
+		}
+	case "sort":
+		lines := readLines(os.Stdin)
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	case "count":
+		// counts repeated lines, like uniq -c
+		lines := readLines(os.Stdin)
+		for i := 0; i < len(lines); {
+			j := i
+			for j < len(lines) && lines[j] == lines[i] {
+				j++
+			}
+			fmt.Printf("%d %s\n", j-i, lines[i])
+			i = j
+		}
+	case "exit":
+		code, _ := strconv.Atoi(args[1])
+		return code
+	default:
+		return 2
+	}
+	return 0
+}
+
+func readLines(r io.Reader) []string {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestRun(t *testing.T) {
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	lang.SetArgs("test.mhzt", []string{dir})
+	lang.Source(`
+		set r = [run] mhzt-helper print 'a  b' 3
+		global quoted = [map-get] {r} \ stdout
+		global code = [map-get] {r} \ code
+		global ok = [map-get] {r} \ ok
+
+		set words = [list] mhzt-helper \ join \ one two \ three
+		global listed = [!] {words}
+		global bang = [!] mhzt-helper join "hello world" again
+
+		set c = [cmd] mhzt-helper cat
+		cmd-stdin from stdin
+		set r = [cmd-run]
+		global stdin = [map-get] {r} \ stdout
+
+		set c = [cmd] mhzt-helper env GREETING
+		cmd-env GREETING \ hi
+		set r = [cmd-run] {c}
+		global env = [map-get] {r} \ stdout
+
+		set c = [cmd] mhzt-helper pwd
+		set dir = [list-get] {args} 0
+		cmd-dir {dir}
+		set r = [cmd-run]
+		global dir = [map-get] {r} \ stdout
+
+		set c = [cmd] mhzt-helper sleep
+		cmd-timeout 50
+		set r = [cmd-run]
+		global timed-out = [map-get] {r} \ timed-out
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("quoted", "a  b")
+	expectGlobalVariable("code", 3)
+	expectGlobalVariable("ok", false)
+	expectGlobalVariable("listed", "one two-three")
+	expectGlobalVariable("bang", "hello world-again")
+	expectGlobalVariable("stdin", "from stdin")
+	expectGlobalVariable("env", "hi")
+	// the same directory may be written differently, with links or short names
+	ran, _ := lang.GetGlobalVar("dir")
+	want, _ := os.Stat(dir)
+	if got, err := os.Stat(strings.TrimSpace(ran.String())); err != nil || !os.SameFile(got, want) {
+		t.Fatalf("command ran in %q instead of %s", ran.String(), dir)
+	}
+	expectGlobalVariable("timed-out", true)
+
+	lang.Source(`
+		run mhzt-helper print 'unterminated
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error for an unterminated quote")
+	}
+}
+
+func TestStart(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		set p = [start] mhzt-helper cat
+		set in = [map-get] {p} \ stdin
+		set out = [map-get] {p} \ stdout
+		set err = [map-get] {p} \ stderr
+		data-write piped through cat \ {in}
+		data-close {in}
+		set r = [proc-wait] {p}
+		global code = [map-get] {r} \ code
+		buf-create got
+		data-copy {out} \ got
+		data-seek 0 \ got
+		global got = [data-read] 17
+		data-close got
+		data-close {out}
+		data-close {err}
+
+		set p = [start] mhzt-helper sleep
+		global running = [proc-running]
+		proc-signal {p} \ KILL
+		set r = [proc-wait]
+		global killed-ok = [map-get] {r} \ ok
+		set in = [map-get] {p} \ stdin
+		data-close {in}
+		set out = [map-get] {p} \ stdout
+		data-close {out}
+		set err = [map-get] {p} \ stderr
+		data-close {err}
+
+		set r = [pipe] mhzt-helper lines b a b \ mhzt-helper sort \ mhzt-helper count
+		global piped = [map-get] {r} \ stdout
+		set r = [pipe] mhzt-helper exit 1 \ mhzt-helper cat
+		global pipe-ok = [map-get] {r} \ ok
+		global pipe-code = [map-get] {r} \ code
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("code", 0)
+	expectGlobalVariable("got", "piped through cat")
+	expectGlobalVariable("running", true)
+	expectGlobalVariable("killed-ok", false)
+	expectGlobalVariable("piped", "1 a\n2 b\n")
+	expectGlobalVariable("pipe-ok", false)
+	expectGlobalVariable("pipe-code", 0)
+
+	lang.Source(`
+		start mhzt-helper sleep
+		buf-create forgotten
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// every problem is reported, not just the first one
+	err = lib.Cleanup()
+	if err == nil {
+		t.Fatal("expected cleanup to report the leftover process")
+	}
+	if !strings.Contains(err.Error(), "killed leftover processes") ||
+		!strings.Contains(err.Error(), "forgotten") {
+		t.Fatalf("expected the process and the stream to be reported, got %v", err)
+	}
+	lang.Source("data-close forgotten")
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"regexp"
+	"testing"
+)
+
+func TestRandom(t *testing.T) {
+	lib.Load()
+	gt = t
+	const src = `
+		random-seed 42
+		global picked = [random-range] 1 \ 6
+		set items = [list] a \ b \ c \ d
+		global choice = [random-choice] {items}
+		set shuffled = [shuffle] {items}
+		global shuffled = [str-join] {shuffled} \ ,
+		global fraction = [random-float] 2 \ 3
+		global bounded = [lrng] 10
+		global same = [random-range] 7 \ 7
+		global widest = [random-range] -9223372036854775808 \ 9223372036854775807
+		global wide = [random-range] -9223372036854775808 \ 0
+		global token = [crypto-token] 8
+		global secret = [crypto-random] 100
+		global id = [uuid]
+	`
+	run := func() map[string]*lang.Object {
+		lang.Source(src)
+		if err := lang.DoAll(); err != nil {
+			if perr, ok := err.(*lang.ParseError); ok {
+				t.Logf("%s %s", perr.Where.String(), perr.Error())
+			}
+			t.Fatal(err.Error())
+		}
+		got := map[string]*lang.Object{}
+		for _, name := range []string{"picked", "choice", "shuffled", "fraction", "bounded"} {
+			got[name], _ = lang.GetGlobalVar(name)
+		}
+		return got
+	}
+	first := run()
+	second := run()
+	// the same seed gives the same numbers
+	for name, o := range first {
+		if !o.Equals(second[name]) {
+			t.Fatalf("%s differs between seeded runs: %s and %s", name, o.Repr(), second[name].Repr())
+		}
+	}
+	if p := first["picked"].IntV; p < 1 || p > 6 {
+		t.Fatalf("random-range gave %d", p)
+	}
+	if f := first["fraction"].FloatV; f < 2 || f >= 3 {
+		t.Fatalf("random-float gave %f", f)
+	}
+	if len(first["shuffled"].StrV) != 7 {
+		t.Fatalf("shuffle lost items: %s", first["shuffled"].StrV)
+	}
+	expectGlobalVariable("same", 7)
+	// ranges wider than the largest int still work
+	if wide, _ := lang.GetGlobalVar("wide"); wide.Type != lang.ObjInt || wide.IntV > 0 {
+		t.Fatalf("random-range gave %s", wide.Repr())
+	}
+	token, _ := lang.GetGlobalVar("token")
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(token.StrV) {
+		t.Fatalf("bad token %s", token.StrV)
+	}
+	id, _ := lang.GetGlobalVar("id")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id.StrV) {
+		t.Fatalf("bad uuid %s", id.StrV)
+	}
+
+	for _, src := range []string{
+		"randi 0",
+		"randi -3",
+		"random-range 5 \\ 1",
+		"set empty = [list]\nrandom-choice {empty}",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"errors"
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func expectDenied(t *testing.T, src string) {
+	lang.Source(src)
+	err := lang.DoAll()
+	var coded interface{ Code() string }
+	if !errors.As(err, &coded) || coded.Code() != "fnc_denied" {
+		t.Fatalf("expected `%s` to be denied, got %v", src, err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	srv := testServer()
+	defer srv.Close()
+	lib.Load()
+	gt = t
+	dir := t.TempDir()
+	lib.Sandbox = &lib.Policy{
+		Read:  []string{dir},
+		Write: []string{dir},
+		Dial:  []string{"127.0.0.1:*"},
+	}
+	defer func() { lib.Sandbox = nil }()
+	allowed := filepath.Join(dir, "allowed.txt")
+	lang.SetArgs("test.mhzt", []string{allowed, srv.URL + "/echo"})
+	lang.Source(`
+		set path = [list-get] {args} 0
+		file-create {path}
+		global exists = [file-exists] {path}
+		set url = [list-get] {args} 1
+		http-get {url}
+		data-close
+		global status = [http-status]
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("exists", true)
+	expectGlobalVariable("status", 200)
+
+	expectDenied(t, "file-create "+filepath.Join(dir, "..", "escaped.txt"))
+	expectDenied(t, "file-delete sandbox_test.go")
+	expectDenied(t, "run mhzt-helper exit 0")
+	expectDenied(t, "env-get HOME")
+	expectDenied(t, "http-get http://example.invalid/")
+	expectDenied(t, "sock-listen localhost:0")
+
+	// matches reached through a link to somewhere else are left out, where
+	// links can be made without special rights
+	if runtime.GOOS == "windows" {
+		return
+	}
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644)
+	os.Symlink(outside, filepath.Join(dir, "link"))
+	os.Mkdir(filepath.Join(dir, "inside"), 0o755)
+	os.WriteFile(filepath.Join(dir, "inside", "secret.txt"), []byte("public"), 0o644)
+	lang.SetArgs("test.mhzt", []string{filepath.Join(dir, "*", "secret.txt")})
+	lang.Source(`
+		set pattern = [list-get] {args} 0
+		set found = [glob] {pattern}
+		global found = [list-len] {found}
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("found", 1)
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"testing"
+)
+
+func TestStr(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		global len = [str-len] héllo
+		global upper = [str-upper str-trim] \t hello \t
+		global title = [str-title] hello wORLD
+		global trimmed = [str-trim] --abc-- \ -
+		global has = [str-contains] hello world \ lo w
+		global starts = [str-starts-with] hello \ he
+		global idx = [str-index-of] hello \ l
+		global sub = [str-sub] hello world \ -5
+		global mid = [str-sub] hello \ 1 3
+		global replaced = [str-replace-all] a-b-c \ - \ +
+		global parts = [str-split] a,b,c \ ,
+		global second = [list-get] {parts} 1
+		global joined = [str-join] {parts} \ ;
+		global glued = [str-join] {parts}
+		global rep = [str-repeat] ab \ 3
+		global padded = [str-pad-left] 7 3 0
+		global reversed = [str-reverse] abc
+		global formatted = [format] %s is %d \ bob \ 5
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("len", 5)
+	expectGlobalVariable("upper", "HELLO")
+	expectGlobalVariable("title", "Hello World")
+	expectGlobalVariable("trimmed", "abc")
+	expectGlobalVariable("has", true)
+	expectGlobalVariable("starts", true)
+	expectGlobalVariable("idx", 2)
+	expectGlobalVariable("sub", "world")
+	expectGlobalVariable("mid", "el")
+	expectGlobalVariable("replaced", "a+b+c")
+	expectGlobalVariable("second", "b")
+	expectGlobalVariable("joined", "a;b;c")
+	expectGlobalVariable("glued", "abc")
+	expectGlobalVariable("rep", "ababab")
+	expectGlobalVariable("padded", "007")
+	expectGlobalVariable("reversed", "cba")
+	expectGlobalVariable("formatted", "bob is 5")
+
+	lang.Source(`
+		set huge = [str-repeat] ab \ 9223372036854775807
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected repeating past the largest length to fail")
+	}
+}
+
+func TestRegex(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		global ok = [re-match] version 1.17.2 \ \d+\.\d+
+		global m = [re-find] go1.17 linux/amd64 \ go(?P<major>\d)\.(\d+)
+		global major = [map-get] {m} \ major
+		global minor = [map-get] {m} 2
+		global all = [re-find-all] a1 b22 c333 \ \w(\d+)
+		global count = [list-len] {all}
+		global last = [list-get] {all} -1
+		global digits = [map-get] {last} 1
+		global replaced = [re-replace] a1b22c333 \ \d+ \ #
+		global unspaced = [re-replace] a b\tc \ \s \ _
+		global parts = [re-split] a1b22c333 \ \d+
+		global first = [list-get] {parts} 0
+		set input = abc123
+		if {input} [matches] ^[a-z]+\d+$
+			global cond-ok = true
+		end
+		unless {input} [matches] ^\d
+			global unless-ok = true
+		end
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("ok", true)
+	expectGlobalVariable("major", "1")
+	expectGlobalVariable("minor", "17")
+	expectGlobalVariable("count", 3)
+	expectGlobalVariable("digits", "333")
+	expectGlobalVariable("replaced", "a#b#c#")
+	expectGlobalVariable("unspaced", "a_b_c")
+	expectGlobalVariable("first", "a")
+	expectGlobalVariable("cond-ok", true)
+	expectGlobalVariable("unless-ok", true)
+}
+
+func TestRegexCache(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		set k = 0
+		loop
+			set pattern = [format] ^a%d$ \ {k}
+			set text = [format] a%d \ {k}
+			global last-ok = [re-match] {text} \ {pattern}
+			set k = [inc] {k}
+		while {k} < 300
+		global first-again = [re-match] a0 \ ^a0$
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("last-ok", true)
+	expectGlobalVariable("first-again", true)
+}
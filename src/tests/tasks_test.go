@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"testing"
+)
+
+func TestSpawn(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Source(`
+		label worker
+			set ch = [list-get] {args} 1
+			lock counter
+			global total = [inc] {total}
+			unlock counter
+			set n = [list-get] {args} 0
+			chan-send {ch} \ {n}
+		end
+		global total = 0
+		set ch = [chan-make] 10
+		set i = 0
+		repeat
+			spawn worker \ {i} \ {ch}
+			set i = [inc] {i}
+		while {i} < 5
+		wait
+		chan-close {ch}
+		set got = 0
+		set v = [chan-recv] {ch}
+		repeat
+			set got = [inc] {got}
+			set v = [chan-recv] {ch}
+		while {v} != nil
+		global got = {got}
+
+		set task = [spawn] str-upper \ hello
+		global upper = [wait] {task}
+
+		set empty = [chan-make]
+		global timed-out = [select] {empty} \ 10
+		set picked = [select] {empty} \ {ch}
+		global picked-ok = [map-get] {picked} \ ok
+		global picked-chan = [map-get] {picked} \ channel
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("total", 5)
+	expectGlobalVariable("got", 5)
+	expectGlobalVariable("upper", "HELLO")
+	expectGlobalVariable("timed-out", nil)
+	expectGlobalVariable("picked-ok", false)
+	expectGlobalVariable("picked-chan", "chan0")
+
+	lang.Source(`
+		label broken
+			not-a-function
+		end
+		set task = [spawn] broken
+		wait {task}
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected the task error to be returned by wait")
+	}
+
+	lang.Source(`
+		set ch = [chan-make]
+		chan-close {ch}
+		chan-send {ch} \ 1
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error sending to a closed channel")
+	}
+}
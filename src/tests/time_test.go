@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"testing"
+	"time"
+)
+
+func TestTime(t *testing.T) {
+	defer func(prev lang.Clock) {
+		lang.Time = prev
+	}(lang.Time)
+	lang.Time = lang.NewFakeClock(time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC))
+	lib.Load()
+	gt = t
+	lang.Source(`
+		set start = [now]
+		global start = {start}
+		global unix = [unix-time]
+		global day = [time-format] {start} \ date
+		global next-year = [time-add-date] {start} \ 1
+		set later = [time-add] {start} \ 2h30m
+		global later-clock = [time-format] {later} \ kitchen
+		global gap = [time-sub] {later} \ {start}
+		global before = [time-before] {start} \ {later}
+		set parsed = [time-parse] 2024-03-01 \ date
+		global spoken = [time-parse] Mar 1, 2024 UTC \ Jan 2, 2006 MST
+		set fields = [time-fields] {parsed}
+		global month = [map-get] {fields} \ month
+		global weekday = [map-get] {fields} \ weekday
+		global ms = [duration-ms] 1m30s
+		global normal = [duration] 1500
+
+		sleep 5s
+		global since = [since] {start}
+		sleep 250
+		global elapsed = [elapsed]
+	`)
+	if err := lang.DoAll(); err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("start", "2024-02-29T12:30:00Z")
+	expectGlobalVariable("unix", 1709209800)
+	expectGlobalVariable("day", "2024-02-29")
+	expectGlobalVariable("next-year", "2025-03-01T12:30:00Z")
+	expectGlobalVariable("later-clock", "3:00PM")
+	expectGlobalVariable("gap", "2h30m0s")
+	expectGlobalVariable("before", true)
+	expectGlobalVariable("spoken", "2024-03-01T00:00:00Z")
+	expectGlobalVariable("month", 3)
+	expectGlobalVariable("weekday", "Friday")
+	expectGlobalVariable("ms", 90000)
+	expectGlobalVariable("normal", "1.5s")
+	expectGlobalVariable("since", "5s")
+	expectGlobalVariable("elapsed", "5.25s")
+
+	for _, src := range []string{
+		"time-add 2024-02-29 \\ 1h",
+		"sleep soon",
+	} {
+		lang.Source(src)
+		if err := lang.DoAll(); err == nil {
+			t.Fatalf("expected `%s` to fail", src)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"mohazit/lang"
+	"mohazit/lib"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAsk(t *testing.T) {
+	lib.Load()
+	gt = t
+	lang.Stdin = strings.NewReader("bob\nnot a number\n4.5\n\nsecret\nmaybe\nn\n9\nblue\n")
+	defer func() { lang.Stdin = os.Stdin }()
+	lang.Source(`
+		global name = [ask] What is your name?
+		global num = [ask-number] Pick a number
+		global empty = [ask]
+		global secret = [ask-secret] Password:
+		global sure = [confirm] Are you sure?
+		global color = [choose] Favourite color? \ red \ green \ blue
+	`)
+	err := lang.DoAll()
+	if err != nil {
+		if perr, ok := err.(*lang.ParseError); ok {
+			t.Logf("%s %s", perr.Where.String(), perr.Error())
+		}
+		t.Fatal(err.Error())
+	}
+
+	expectGlobalVariable("name", "bob")
+	expectGlobalVariable("num", 4.5)
+	expectGlobalVariable("empty", "")
+	expectGlobalVariable("secret", "secret")
+	expectGlobalVariable("sure", false)
+	expectGlobalVariable("color", "blue")
+
+	lang.Source(`
+		global more = [ask]
+	`)
+	if err := lang.DoAll(); err == nil {
+		t.Fatal("expected an error when running out of input")
+	}
+
+	// prompts skip captures and go straight to the terminal
+	out := &strings.Builder{}
+	lang.Stdout = out
+	defer func() { lang.Stdout = os.Stdout }()
+	lang.Stdin = strings.NewReader("yes\n")
+	lang.Source(`
+		capture said
+			global agreed = [confirm] Proceed?
+		end
+		global said = {said}
+	`)
+	if err := lang.DoAll(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGlobalVariable("agreed", true)
+	expectGlobalVariable("said", "")
+	if out.String() != "Proceed? [y/n] " {
+		t.Fatalf("expected the prompt on the terminal, got %q", out.String())
+	}
+}